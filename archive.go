@@ -0,0 +1,334 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// archiveExt sits between the stored name and the codec extension of a
+// directory kept as an archive: name.tar.gz, name.tar.zst
+const archiveExt = ".tar"
+
+// xattrPAXPrefix is the PAX record prefix GNU tar and bsdtar use for
+// extended attributes
+const xattrPAXPrefix = "SCHILY.xattr."
+
+// archiveDir streams the tree at src into a compressed tar archive at dst,
+// keeping modes, ownership, timestamps, xattrs, symlinks and hard links.
+// The attributes of src itself are recorded in the entry, not the archive.
+func archiveDir(src, dst string, c codec, level int) error {
+	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer dstFile.Close()
+
+	writer, err := c.newWriter(dstFile, level)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	tw := tar.NewWriter(writer)
+	defer tw.Close()
+
+	type inode struct{ dev, ino uint64 }
+	linked := make(map[inode]string)
+
+	err = filepath.Walk(src, func(path string, info os.FileInfo, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if path == src {
+			return nil
+		}
+
+		// Sockets can't be archived, and are useless once their server is gone
+		if info.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		var linkTarget string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if linkTarget, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, linkTarget)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		header.Format = tar.FormatPAX
+
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			header.AccessTime = time.Unix(stat.Atim.Unix())
+
+			if info.Mode().IsRegular() && stat.Nlink > 1 {
+				key := inode{uint64(stat.Dev), uint64(stat.Ino)}
+				if first, ok := linked[key]; ok {
+					header.Typeflag = tar.TypeLink
+					header.Linkname = first
+					header.Size = 0
+				} else {
+					linked[key] = header.Name
+				}
+			}
+		}
+
+		for name, value := range readXattrs(path) {
+			if header.PAXRecords == nil {
+				header.PAXRecords = make(map[string]string)
+			}
+			header.PAXRecords[xattrPAXPrefix+name] = string(value)
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to close %s writer: %w", c.name, err)
+	}
+	if err := dstFile.Sync(); err != nil {
+		return err
+	}
+	return dstFile.Close()
+}
+
+// checkArchive reads the archive at src through to its end, so a truncated
+// or damaged archive is caught before anything is extracted
+func checkArchive(src string, c codec) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	reader, err := c.newReader(srcFile)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	tr := tar.NewReader(reader)
+	for {
+		if _, err := tr.Next(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("damaged archive: %w", err)
+		}
+		if _, err := io.Copy(io.Discard, tr); err != nil {
+			return fmt.Errorf("damaged archive: %w", err)
+		}
+	}
+}
+
+// extractArchive recreates the directory archived at src as dst, which must
+// not exist yet. Names that would land outside dst are refused, and symlinks
+// are created only after everything else, so the archive can't plant one
+// and then write through it. On failure, dst is removed only if this call
+// created it.
+func extractArchive(src, dst string, c codec) (err error) {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	reader, err := c.newReader(srcFile)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	if err := os.Mkdir(dst, 0700); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dst)
+		}
+	}()
+
+	type extracted struct {
+		path       string
+		linkTarget string
+		attrs      *FileAttrs
+	}
+	var files, dirs, symlinks []extracted
+
+	tr := tar.NewReader(reader)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		target, err := archiveTarget(dst, header.Name)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return err
+		}
+		item := extracted{path: target, attrs: headerAttrs(header)}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.Mkdir(target, 0700); err != nil && !os.IsExist(err) {
+				return err
+			}
+			dirs = append(dirs, item)
+
+		case tar.TypeReg:
+			f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+			files = append(files, item)
+
+		case tar.TypeLink:
+			first, err := archiveTarget(dst, header.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := os.Link(first, target); err != nil {
+				return err
+			}
+
+		case tar.TypeSymlink:
+			item.linkTarget = header.Linkname
+			item.attrs.Mode |= os.ModeSymlink
+			symlinks = append(symlinks, item)
+
+		case tar.TypeFifo, tar.TypeChar, tar.TypeBlock:
+			mode := uint32(unix.S_IFIFO)
+			switch header.Typeflag {
+			case tar.TypeChar:
+				mode = unix.S_IFCHR
+			case tar.TypeBlock:
+				mode = unix.S_IFBLK
+			}
+			dev := unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor))
+			if err := unix.Mknod(target, mode|0600, int(dev)); err != nil {
+				return &os.PathError{Op: "mknod", Path: target, Err: err}
+			}
+			files = append(files, item)
+
+		default:
+			return fmt.Errorf("unsupported entry '%s' in archive", header.Name)
+		}
+	}
+
+	for _, link := range symlinks {
+		if err := os.Symlink(link.linkTarget, link.path); err != nil {
+			return err
+		}
+	}
+
+	// Attributes go on once everything is in place: children before their
+	// directories, so creating entries doesn't disturb a directory's mtime
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i].path) > len(dirs[j].path) })
+	var firstErr error
+	for _, group := range [][]extracted{files, symlinks, dirs} {
+		for _, item := range group {
+			if err := applyAttrs(item.path, item.attrs); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if firstErr != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not restore all attributes under '%s': %v\n", dst, firstErr)
+	}
+
+	return nil
+}
+
+// archiveTarget resolves an archive member name below dst, refusing absolute
+// names and any that climb out with ".."
+func archiveTarget(dst, name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("refusing to extract '%s' outside '%s'", name, dst)
+	}
+	return filepath.Join(dst, clean), nil
+}
+
+// headerAttrs converts the metadata of an archive member to FileAttrs
+func headerAttrs(header *tar.Header) *FileAttrs {
+	attrs := &FileAttrs{
+		Mode:       os.FileMode(header.Mode) & permissionBits,
+		UID:        header.Uid,
+		GID:        header.Gid,
+		AccessTime: header.AccessTime,
+		ModTime:    header.ModTime,
+	}
+
+	// tar keeps setuid/setgid/sticky in the C-style bits
+	if header.Mode&04000 != 0 {
+		attrs.Mode |= os.ModeSetuid
+	}
+	if header.Mode&02000 != 0 {
+		attrs.Mode |= os.ModeSetgid
+	}
+	if header.Mode&01000 != 0 {
+		attrs.Mode |= os.ModeSticky
+	}
+
+	for key, value := range header.PAXRecords {
+		if name, ok := strings.CutPrefix(key, xattrPAXPrefix); ok {
+			if attrs.Xattrs == nil {
+				attrs.Xattrs = make(map[string][]byte)
+			}
+			attrs.Xattrs[name] = []byte(value)
+		}
+	}
+	return attrs
+}
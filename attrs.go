@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// FileAttrs is the inode metadata recorded when a file is deleted and
+// reapplied when it is restored. POSIX ACLs and SELinux labels are carried
+// as the system.posix_acl_* and security.* extended attributes.
+type FileAttrs struct {
+	Mode       os.FileMode       `json:"mode"`
+	UID        int               `json:"uid"`
+	GID        int               `json:"gid"`
+	AccessTime time.Time         `json:"access_time"`
+	ModTime    time.Time         `json:"mod_time"`
+	Xattrs     map[string][]byte `json:"xattrs,omitempty"`
+}
+
+// permissionBits are the parts of os.FileMode that chmod can set
+const permissionBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// captureAttrs records the attributes of path, without following symlinks
+func captureAttrs(path string, info os.FileInfo) *FileAttrs {
+	attrs := &FileAttrs{
+		Mode:    info.Mode(),
+		ModTime: info.ModTime(),
+	}
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		attrs.UID = int(stat.Uid)
+		attrs.GID = int(stat.Gid)
+		attrs.AccessTime = time.Unix(stat.Atim.Unix())
+	}
+
+	attrs.Xattrs = readXattrs(path)
+	return attrs
+}
+
+func readXattrs(path string) map[string][]byte {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size <= 0 {
+		return nil
+	}
+
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(path, buf)
+	if err != nil {
+		return nil
+	}
+
+	xattrs := make(map[string][]byte)
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+
+		valueSize, err := unix.Lgetxattr(path, string(name), nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, valueSize)
+		if valueSize > 0 {
+			if valueSize, err = unix.Lgetxattr(path, string(name), value); err != nil {
+				continue
+			}
+		}
+		xattrs[string(name)] = value[:valueSize]
+	}
+
+	if len(xattrs) == 0 {
+		return nil
+	}
+	return xattrs
+}
+
+// applyAttrs puts recorded attributes back on path. Ownership and
+// attributes in namespaces only root may write are restored when permitted
+// and skipped silently otherwise; any other failure is reported.
+func applyAttrs(path string, attrs *FileAttrs) error {
+	if attrs == nil {
+		return nil
+	}
+
+	var firstErr error
+	keep := func(err error) {
+		if err != nil && firstErr == nil && !isPermissionError(err) {
+			firstErr = err
+		}
+	}
+
+	// chown clears setuid/setgid, so it has to come before chmod
+	keep(os.Lchown(path, attrs.UID, attrs.GID))
+
+	for name, value := range attrs.Xattrs {
+		if err := unix.Lsetxattr(path, name, value, 0); err != nil && !errors.Is(err, unix.ENOTSUP) {
+			keep(err)
+		}
+	}
+
+	if attrs.Mode&os.ModeSymlink == 0 {
+		keep(os.Chmod(path, attrs.Mode&permissionBits))
+	}
+
+	// Timestamps go last, since every change above touches ctime/mtime
+	times := []unix.Timespec{
+		unix.NsecToTimespec(attrs.AccessTime.UnixNano()),
+		unix.NsecToTimespec(attrs.ModTime.UnixNano()),
+	}
+	if attrs.AccessTime.IsZero() {
+		times[0] = times[1]
+	}
+	keep(unix.UtimesNanoAt(unix.AT_FDCWD, path, times, unix.AT_SYMLINK_NOFOLLOW))
+
+	return firstErr
+}
+
+func isPermissionError(err error) bool {
+	return errors.Is(err, os.ErrPermission) || errors.Is(err, unix.EPERM)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec names recorded in RecycleBinEntry.Codec and selectable through
+// RecycleBinConfig.Codec
+const (
+	codecGzip = "gzip"
+	codecZstd = "zstd"
+	codecNone = "none"
+)
+
+// codec is a compression format files can be stored in
+type codec struct {
+	name         string
+	ext          string // appended to the stored name
+	defaultLevel int
+	newWriter    func(w io.Writer, level int) (io.WriteCloser, error)
+	newReader    func(r io.Reader) (io.ReadCloser, error)
+}
+
+var codecs = map[string]codec{
+	codecGzip: {
+		name:         codecGzip,
+		ext:          ".gz",
+		defaultLevel: gzip.BestSpeed,
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, level)
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	codecZstd: {
+		name:         codecZstd,
+		ext:          ".zst",
+		defaultLevel: 3,
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			decoder, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return decoder.IOReadCloser(), nil
+		},
+	},
+	codecNone: {name: codecNone},
+}
+
+// defaultSkipExtensions are formats that are compressed already, used when
+// RecycleBinConfig.SkipExtensions is not set
+var defaultSkipExtensions = []string{
+	".jpg", ".jpeg", ".png", ".gif", ".webp", ".heic",
+	".mp3", ".ogg", ".flac", ".m4a", ".mp4", ".mkv", ".mov", ".avi", ".webm",
+	".zip", ".gz", ".tgz", ".bz2", ".xz", ".zst", ".7z", ".rar",
+	".jar", ".apk", ".docx", ".xlsx", ".pptx", ".odt", ".pdf",
+}
+
+// entropyThreshold is the bits per byte above which a sampled file is taken
+// to be compressed or encrypted already
+const entropyThreshold = 7.5
+
+// entropySampleSize is how much of a file is read to estimate its entropy
+const entropySampleSize = 64 * 1024
+
+// entryCodec returns the codec entry is stored with, or will be once it is
+// compacted. Entries from before codecs were recorded are gzip.
+func entryCodec(entry RecycleBinEntry) codec {
+	if c, ok := codecs[entry.Codec]; ok {
+		return c
+	}
+	if entry.IsCompressed || entry.PendingCompression {
+		return codecs[codecGzip]
+	}
+	return codecs[codecNone]
+}
+
+func entryCodecLevel(entry RecycleBinEntry) int {
+	if entry.CodecLevel != 0 {
+		return entry.CodecLevel
+	}
+	return entryCodec(entry).defaultLevel
+}
+
+// codecLabel describes how entry is stored for --list-recycle-bin
+func codecLabel(entry RecycleBinEntry) string {
+	if isSpecialEntry(entry) {
+		return "-"
+	}
+	c := entryCodec(entry)
+	if c.name == codecNone {
+		if entry.IsDirectory {
+			return "-"
+		}
+		return codecNone
+	}
+	label := fmt.Sprintf("%s-%d", c.name, entryCodecLevel(entry))
+	if entry.IsDirectory {
+		label = "tar+" + label
+	}
+	return label
+}
+
+// chooseCodec picks the codec and level for the file at path: none for
+// formats that are compressed already, otherwise the configured codec
+func chooseCodec(config *RecycleBinConfig, path string) (string, int) {
+	if isPrecompressed(config, path) {
+		return codecNone, 0
+	}
+	return configuredCodec(config)
+}
+
+// configuredCodec returns the codec and level set in config
+func configuredCodec(config *RecycleBinConfig) (string, int) {
+	name := config.Codec
+	if _, ok := codecs[name]; !ok {
+		name = codecGzip
+	}
+	if name == codecNone {
+		return codecNone, 0
+	}
+
+	level := config.CodecLevel
+	if level == 0 {
+		level = codecs[name].defaultLevel
+	}
+	return name, level
+}
+
+// isPrecompressed reports whether compressing path would be wasted effort,
+// judged by its extension and, if enabled, by a sample of its contents
+func isPrecompressed(config *RecycleBinConfig, path string) bool {
+	extensions := config.SkipExtensions
+	if extensions == nil {
+		extensions = defaultSkipExtensions
+	}
+
+	ext := filepath.Ext(path)
+	for _, skip := range extensions {
+		if ext != "" && strings.EqualFold(ext, "."+strings.TrimPrefix(skip, ".")) {
+			return true
+		}
+	}
+
+	return config.SkipHighEntropy && sampleEntropy(path) > entropyThreshold
+}
+
+// sampleEntropy returns the Shannon entropy, in bits per byte, of the start
+// of the file at path. Files too small to judge count as 0.
+func sampleEntropy(path string) float64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	buf := make([]byte, entropySampleSize)
+	n, _ := io.ReadFull(f, buf)
+	if n < 4096 {
+		return 0
+	}
+
+	var counts [256]int
+	for _, b := range buf[:n] {
+		counts[b]++
+	}
+
+	var entropy float64
+	for _, count := range counts {
+		if count == 0 {
+			continue
+		}
+		p := float64(count) / float64(n)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// codecExt returns the codec suffix name ends with, if any
+func codecExt(name string) (string, bool) {
+	for _, c := range codecs {
+		if c.ext != "" && strings.HasSuffix(name, c.ext) {
+			return c.ext, true
+		}
+	}
+	return "", false
+}
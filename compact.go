@@ -0,0 +1,395 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// compactLockName is held by the one compaction pass allowed per bin at a time
+const compactLockName = "compact.lock"
+
+// compactor is implemented by stores that leave files pending compression
+type compactor interface {
+	// Compact compresses every pending entry and returns the entries it compressed
+	Compact() ([]RecycleBinEntry, error)
+}
+
+func compactRecycleBin() {
+	config, err := loadRecycleBinConfig()
+	if err != nil {
+		failf(codeConfig, "Failed to load config: %v", err)
+		return
+	}
+
+	c, ok := openStore(config).(compactor)
+	if !ok {
+		out.text("Nothing to compact: the desktop Trash keeps files uncompressed\n")
+		return
+	}
+
+	compacted, err := c.Compact()
+
+	var saved int64
+	for _, entry := range compacted {
+		rec := newEntryRecord(entry)
+		rec.StoredSize = entry.CompressedSize
+		out.emit(outputRecord{Type: "compressed", ID: entry.ID, Path: entry.OriginalPath, Entry: rec},
+			"Compressed '%s' (%s -> %s)\n", entry.OriginalPath,
+			formatSize(entry.OriginalSize), formatSize(entry.CompressedSize))
+		saved += entry.OriginalSize - entry.CompressedSize
+	}
+
+	if err != nil {
+		failf(errorCode(err), "Failed to compact recycle bin: %v", err)
+		return
+	}
+
+	counts := map[string]int{"compacted": len(compacted), "saved_bytes": int(saved)}
+	if len(compacted) == 0 {
+		out.summarize(counts, "Nothing to compact\n")
+		return
+	}
+	out.summarize(counts, "Compacted %d files, saving %s\n", len(compacted), formatSize(saved))
+}
+
+// startBackgroundCompaction runs --compact-recycle-bin in a detached,
+// low-priority process, so rm itself returns as soon as files are renamed
+func startBackgroundCompaction() {
+	config, err := loadRecycleBinConfig()
+	if err != nil || config.ManualCompaction || usesFreeDesktopTrash(config) {
+		return
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return
+	}
+
+	cmd := exec.Command(exe, "--compact-recycle-bin")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return
+	}
+	unix.Setpriority(unix.PRIO_PROCESS, cmd.Process.Pid, 10)
+	cmd.Process.Release()
+}
+
+func (s *mountStore) Compact() ([]RecycleBinEntry, error) {
+	var compacted []RecycleBinEntry
+	var firstErr error
+	for _, bin := range s.discover() {
+		binCompacted, err := bin.Compact()
+		compacted = append(compacted, binCompacted...)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return compacted, firstErr
+}
+
+func (s *dirStore) Compact() ([]RecycleBinEntry, error) {
+	lock, err := s.lockCompaction()
+	if lock == nil {
+		// Another pass is already working on this bin, or err says why not
+		return nil, err
+	}
+	defer lock.Close()
+
+	pending, err := s.startCompaction()
+	if err != nil {
+		return nil, err
+	}
+
+	var compacted []RecycleBinEntry
+	var firstErr error
+	for _, entry := range pending {
+		if entry.PendingChecksum && !entry.PendingCompression {
+			// Stored as it is for good; only the checksum is missing
+			if err := s.recordChecksum(entry); err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("'%s': %v", entry.OriginalPath, err)
+			}
+			continue
+		}
+		if !entry.PendingCompression {
+			continue
+		}
+
+		compressed, ok, err := s.compactEntry(entry)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("'%s': %v", entry.OriginalPath, err)
+			}
+			continue
+		}
+		if ok {
+			compacted = append(compacted, compressed)
+		}
+	}
+
+	return compacted, firstErr
+}
+
+// startCompaction clears what an earlier pass left behind and returns the
+// entries waiting to be compressed. Compressing them happens without the
+// bin lock, so rm isn't held up meanwhile.
+func (s *dirStore) startCompaction() ([]RecycleBinEntry, error) {
+	unlock, err := s.Lock(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	for _, path := range s.compactionLeftovers() {
+		os.RemoveAll(path)
+	}
+	return s.index.entries(), nil
+}
+
+// lockCompaction takes the compaction lock of the bin without waiting for
+// it. The lock is released by closing the returned file, which is nil when
+// another process holds the lock.
+func (s *dirStore) lockCompaction() (*os.File, error) {
+	lock, err := os.OpenFile(filepath.Join(s.metadataDir(), compactLockName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		lock.Close()
+		if err == unix.EWOULDBLOCK {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return lock, nil
+}
+
+// compactEntry replaces the stored file of entry with a compressed copy, or
+// with a link to an identical blob when the bin deduplicates. The original
+// is removed only once the copy is synced, renamed into place and recorded,
+// so an interrupted pass leaves either one complete copy or both.
+func (s *dirStore) compactEntry(entry RecycleBinEntry) (RecycleBinEntry, bool, error) {
+	src := s.storedPath(entry)
+
+	// The stored file is still uncompressed, so its hash is the checksum of
+	// the contents that rm left for this pass to take
+	var sum string
+	if entry.PendingChecksum || s.dedup && !entry.IsDirectory {
+		var err error
+		if sum, err = hashFile(src); err != nil {
+			return entry, false, err
+		}
+	}
+	if entry.PendingChecksum {
+		entry.SHA256, entry.PendingChecksum = sum, false
+	}
+
+	if s.dedup && !entry.IsDirectory {
+		if c, ok := s.findBlob(sum); ok {
+			return s.shareBlob(entry, sum, c)
+		}
+	}
+
+	c := entryCodec(entry)
+	compressed := entry
+	compressed.StoredName = entry.StoredName + c.ext
+	compressed.IsCompressed = true
+	compressed.PendingCompression = false
+
+	compress := compressFileInPlace
+	if entry.IsDirectory {
+		compressed.StoredName = entry.StoredName + archiveExt + c.ext
+		compressed.IsArchive = true
+		compress = archiveDir
+	}
+
+	dst := s.storedPath(compressed)
+	tempPath := dst + ".tmp"
+
+	if err := compress(src, tempPath, c, entryCodecLevel(entry)); err != nil {
+		os.Remove(tempPath)
+		return entry, false, err
+	}
+	if err := os.Rename(tempPath, dst); err != nil {
+		os.Remove(tempPath)
+		return entry, false, err
+	}
+	if err := syncDir(s.root); err != nil {
+		return entry, false, err
+	}
+
+	// A bin on a file system without hard links just keeps its own copy
+	if sum != "" && s.addBlob(dst, sum, c) == nil {
+		compressed.Blob = sum
+	}
+
+	return s.commitCompaction(entry, compressed)
+}
+
+// shareBlob replaces the stored file of entry with a link to the existing
+// blob for sum, stored with codec c
+func (s *dirStore) shareBlob(entry RecycleBinEntry, sum string, c codec) (RecycleBinEntry, bool, error) {
+	shared := entry
+	shared.StoredName = entry.StoredName + c.ext
+	shared.IsCompressed = c.name != codecNone
+	shared.PendingCompression = false
+	shared.Blob = sum
+	if c.name != entryCodec(entry).name {
+		shared.Codec = c.name
+		shared.CodecLevel = 0
+	}
+
+	// Link under a temporary name first: with no codec the blob's stored
+	// name is the pending file's own
+	dst := s.storedPath(shared)
+	tempPath := dst + ".tmp"
+	os.Remove(tempPath)
+	if err := os.Link(s.blobPath(sum, c), tempPath); err != nil {
+		return entry, false, err
+	}
+	if err := os.Rename(tempPath, dst); err != nil {
+		os.Remove(tempPath)
+		return entry, false, err
+	}
+	if err := syncDir(s.root); err != nil {
+		return entry, false, err
+	}
+
+	return s.commitCompaction(entry, shared)
+}
+
+// commitCompaction records that entry is now stored as compressed and
+// removes the pending original, unless the entry went away in the meantime
+func (s *dirStore) commitCompaction(entry, compressed RecycleBinEntry) (RecycleBinEntry, bool, error) {
+	src := s.storedPath(entry)
+	dst := s.storedPath(compressed)
+
+	unlock, err := s.Lock(true)
+	if err != nil {
+		return entry, false, err
+	}
+	defer unlock()
+
+	// The entry may have been restored, deleted or partly restored by
+	// another rm meanwhile
+	if err := s.load(); err != nil {
+		return entry, false, err
+	}
+	if current, ok := s.index.get(entry.ID); !ok || !current.PendingCompression || current.OriginalSize != entry.OriginalSize {
+		os.Remove(dst)
+		s.releaseBlob(compressed)
+		return entry, false, nil
+	}
+
+	if info, err := os.Stat(dst); err == nil {
+		compressed.CompressedSize = info.Size()
+	}
+	if err := s.index.put(compressed); err != nil {
+		if dst != src {
+			os.Remove(dst)
+			s.releaseBlob(compressed)
+		}
+		return entry, false, err
+	}
+
+	if dst != src {
+		os.RemoveAll(src)
+	}
+	return compressed, true, nil
+}
+
+// recordChecksum records the checksum of a file that stays uncompressed.
+// Like compressing, hashing it happens without the bin lock.
+func (s *dirStore) recordChecksum(entry RecycleBinEntry) error {
+	sum, err := hashFile(s.storedPath(entry))
+	if err != nil {
+		return err
+	}
+
+	unlock, err := s.Lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+	current, ok := s.index.get(entry.ID)
+	if !ok || !current.PendingChecksum || current.StoredName != entry.StoredName {
+		return nil
+	}
+	current.SHA256, current.PendingChecksum = sum, false
+	return s.index.put(current)
+}
+
+// compactionLeftovers returns what an interrupted pass left behind:
+// half-written .tmp files, and originals whose compressed copy was already
+// recorded
+func (s *dirStore) compactionLeftovers() []string {
+	live := make(map[string]bool)
+	for _, entry := range s.index.entries() {
+		live[entry.StoredName] = true
+	}
+
+	dirEntries, err := os.ReadDir(s.root)
+	if err != nil {
+		return nil
+	}
+
+	var leftovers []string
+	for _, dirEntry := range dirEntries {
+		if isCompactionTemp(dirEntry.Name(), live) {
+			leftovers = append(leftovers, filepath.Join(s.root, dirEntry.Name()))
+		}
+	}
+
+	for _, entry := range s.index.entries() {
+		if !entry.IsCompressed {
+			continue
+		}
+		original := strings.TrimSuffix(entry.StoredName, entryCodec(entry).ext)
+		if entry.IsArchive {
+			original = strings.TrimSuffix(original, archiveExt)
+		}
+		if original == entry.StoredName || live[original] {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(s.root, original)); err == nil {
+			leftovers = append(leftovers, filepath.Join(s.root, original))
+		}
+	}
+
+	return leftovers
+}
+
+// isCompactionTemp reports whether name is the temporary copy of a
+// compaction, given the stored names of the live entries: a compressed name
+// or, when sharing an uncompressed blob, a live name followed by .tmp
+func isCompactionTemp(name string, live map[string]bool) bool {
+	base, ok := strings.CutSuffix(name, ".tmp")
+	if !ok || live[name] {
+		return false
+	}
+	_, compressed := codecExt(base)
+	return compressed || live[base]
+}
+
+// syncDir flushes the entries of dir, making renames within it durable
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// blobDirName holds the content-addressed blobs of a bin, one file per
+// distinct content, named by its SHA-256 plus the codec extension. Entries
+// share a blob by hard-linking their stored file to it, so the blob's link
+// count is its reference count: a blob whose count is back to 1 is garbage.
+const blobDirName = ".blobs"
+
+// blobSweeper is implemented by stores that deduplicate into shared blobs
+type blobSweeper interface {
+	// SweepBlobs removes blobs no entry refers to and returns how many it removed
+	SweepBlobs() (int, error)
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func (s *dirStore) blobPath(sum string, c codec) string {
+	return filepath.Join(s.root, blobDirName, sum[:2], sum+c.ext)
+}
+
+// findBlob returns the codec the blob with the given SHA-256 is stored with
+func (s *dirStore) findBlob(sum string) (codec, bool) {
+	for _, c := range codecs {
+		if _, err := os.Lstat(s.blobPath(sum, c)); err == nil {
+			return c, true
+		}
+	}
+	return codec{}, false
+}
+
+// addBlob makes the stored file at path the blob for sum
+func (s *dirStore) addBlob(path, sum string, c codec) error {
+	blob := s.blobPath(sum, c)
+	if err := os.MkdirAll(filepath.Dir(blob), 0700); err != nil {
+		return err
+	}
+	return os.Link(path, blob)
+}
+
+// releaseBlob drops the blob of entry, whose stored file is already gone, if
+// no other entry refers to it
+func (s *dirStore) releaseBlob(entry RecycleBinEntry) {
+	if entry.Blob == "" {
+		return
+	}
+	blob := s.blobPath(entry.Blob, entryCodec(entry))
+	if linkCount(blob) == 1 {
+		os.Remove(blob)
+	}
+}
+
+func (s *dirStore) SweepBlobs() (int, error) {
+	removed := 0
+	err := filepath.Walk(filepath.Join(s.root, blobDirName), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() && linkCount(path) == 1 {
+			if err := os.Remove(path); err == nil {
+				removed++
+			}
+		}
+		return nil
+	})
+	return removed, err
+}
+
+func (s *mountStore) SweepBlobs() (int, error) {
+	removed := 0
+	var firstErr error
+	for _, bin := range s.discover() {
+		n, err := bin.SweepBlobs()
+		removed += n
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return removed, firstErr
+}
+
+func linkCount(path string) uint64 {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return 0
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+	return uint64(stat.Nlink)
+}
+
+// dedupSavings returns how many bytes sharing blobs saves across entries,
+// given the size each entry's payload occupies
+func dedupSavings(entries []RecycleBinEntry, sizes map[string]int64) (int64, int) {
+	refs := make(map[string]int)
+	blobSize := make(map[string]int64)
+	for _, entry := range entries {
+		if entry.Blob == "" {
+			continue
+		}
+		refs[entry.Blob]++
+		blobSize[entry.Blob] = sizes[entry.ID]
+	}
+
+	var saved int64
+	shared := 0
+	for blob, count := range refs {
+		if count > 1 {
+			saved += int64(count-1) * blobSize[blob]
+			shared++
+		}
+	}
+	return saved, shared
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Storage backends selectable through RecycleBinConfig.Backend
+const (
+	backendBetterRM    = "better-rm"
+	backendFreeDesktop = "freedesktop"
+)
+
+// trashInfoDateFormat is the DeletionDate layout required by the Trash spec
+const trashInfoDateFormat = "2006-01-02T15:04:05"
+
+// trashInfoTransactionKey records the invocation that trashed the file
+const trashInfoTransactionKey = "X-BetterRm-Transaction"
+
+// trashInfoChecksumKey records the SHA-256 of a trashed file's contents
+const trashInfoChecksumKey = "X-BetterRm-SHA256"
+
+// trashDir is one FreeDesktop.org trash directory (containing files/ and info/).
+// topDir is empty for the home trash and the volume root for $topdir trashes.
+type trashDir struct {
+	path   string
+	topDir string
+}
+
+func usesFreeDesktopTrash(config *RecycleBinConfig) bool {
+	return config.Backend == backendFreeDesktop
+}
+
+func getHomeTrashPath() string {
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return filepath.Join("/tmp", "better-rm-trash")
+		}
+		dataHome = filepath.Join(homeDir, ".local", "share")
+	}
+	return filepath.Join(dataHome, "Trash")
+}
+
+func initFreeDesktopTrash() error {
+	home := getHomeTrashPath()
+	if err := os.MkdirAll(filepath.Join(home, "files"), 0700); err != nil {
+		return err
+	}
+	return os.MkdirAll(filepath.Join(home, "info"), 0700)
+}
+
+// volumeTrashDir returns the trash directory to use for files under topDir,
+// creating $topdir/.Trash/$uid or $topdir/.Trash-$uid as the spec describes
+func volumeTrashDir(topDir string) (trashDir, error) {
+	uid := strconv.Itoa(os.Getuid())
+
+	// An administrator-provided $topdir/.Trash must be a real directory with
+	// the sticky bit set, otherwise it has to be ignored
+	shared := filepath.Join(topDir, ".Trash")
+	if info, err := os.Lstat(shared); err == nil && info.IsDir() && info.Mode()&os.ModeSticky != 0 {
+		dir := filepath.Join(shared, uid)
+		if err := os.MkdirAll(dir, 0700); err == nil {
+			return trashDir{path: dir, topDir: topDir}, nil
+		}
+	}
+
+	dir := filepath.Join(topDir, ".Trash-"+uid)
+	if info, err := os.Lstat(dir); err == nil && (!info.IsDir() || info.Mode()&os.ModeSymlink != 0) {
+		return trashDir{}, fmt.Errorf("'%s' is not a directory", dir)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return trashDir{}, err
+	}
+	return trashDir{path: dir, topDir: topDir}, nil
+}
+
+// trashDirFor picks the trash directory that lets absPath be moved with a
+// plain rename: the home trash when it shares a device, else a volume trash
+func trashDirFor(absPath string) trashDir {
+	home := trashDir{path: getHomeTrashPath()}
+
+	parent := filepath.Dir(absPath)
+	if !isOnDifferentDevice(parent, home.path) {
+		return home
+	}
+
+	topDir, err := findMountRoot(parent)
+	if err != nil {
+		return home
+	}
+
+	dir, err := volumeTrashDir(topDir)
+	if err != nil {
+		return home
+	}
+	return dir
+}
+
+// knownTrashDirs lists the home trash and every volume trash that exists on a
+// currently mounted file system
+func knownTrashDirs() []trashDir {
+	dirs := []trashDir{{path: getHomeTrashPath()}}
+
+	mounts, err := listMountPoints()
+	if err != nil {
+		return dirs
+	}
+
+	uid := strconv.Itoa(os.Getuid())
+	for _, mount := range mounts {
+		for _, candidate := range []string{
+			filepath.Join(mount, ".Trash", uid),
+			filepath.Join(mount, ".Trash-"+uid),
+		} {
+			if candidate == dirs[0].path {
+				continue
+			}
+			if info, err := os.Lstat(filepath.Join(candidate, "info")); err == nil && info.IsDir() {
+				dirs = append(dirs, trashDir{path: candidate, topDir: mount})
+			}
+		}
+	}
+
+	return dirs
+}
+
+// trashStore keeps the recycle bin in the FreeDesktop.org trash directories
+type trashStore struct {
+	byID map[string]trashItem // loaded lazily from every known trash
+}
+
+// trashItem is an entry together with its files/ and info/ paths
+type trashItem struct {
+	entry      RecycleBinEntry
+	storedPath string
+	infoPath   string
+}
+
+func (s *trashStore) Put(originalPath string, entry *RecycleBinEntry) error {
+	absPath := entry.OriginalPath
+	dir := trashDirFor(absPath)
+	filesDir := filepath.Join(dir.path, "files")
+	infoDir := filepath.Join(dir.path, "info")
+	if err := os.MkdirAll(filesDir, 0700); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(infoDir, 0700); err != nil {
+		return err
+	}
+
+	// Volume trashes store paths relative to their top directory so the
+	// entries stay valid when removable media is mounted elsewhere
+	recordedPath := absPath
+	if dir.topDir != "" {
+		if rel, err := filepath.Rel(dir.topDir, absPath); err == nil && !strings.HasPrefix(rel, "..") {
+			recordedPath = rel
+		}
+	}
+
+	contents := fmt.Sprintf("[Trash Info]\nPath=%s\nDeletionDate=%s\n",
+		escapeTrashPath(recordedPath), entry.DeletedAt.Format(trashInfoDateFormat))
+
+	// Other implementations ignore keys they don't know, so better-rm's own
+	// bookkeeping can ride along in the same file
+	if entry.TransactionID != "" {
+		contents += fmt.Sprintf("%s=%s\n", trashInfoTransactionKey, entry.TransactionID)
+	}
+
+	name, infoPath, err := createTrashInfo(infoDir, filepath.Base(absPath), contents)
+	if err != nil {
+		return err
+	}
+
+	// The .trashinfo reserves the name, but another program may still have
+	// left a file of that name in files/, and it is never replaced
+	destPath := filepath.Join(filesDir, name)
+	var removeErr error
+	if err := renameNoReplace(originalPath, destPath); err != nil && !errors.Is(err, unix.EXDEV) {
+		// Only another file system calls for a copy, as in dirStore.Put
+		os.Remove(infoPath)
+		return err
+	} else if err != nil {
+		if err := copyFile(originalPath, destPath); err != nil {
+			if !errors.Is(err, fs.ErrExist) {
+				os.RemoveAll(destPath)
+			}
+			os.Remove(infoPath)
+			return err
+		}
+
+		// Once part of a directory is gone the copy is all that holds it
+		before := countTree(originalPath)
+		if removeErr = os.RemoveAll(originalPath); removeErr != nil &&
+			!(entry.IsDirectory && countTree(originalPath) < before) {
+			os.RemoveAll(destPath)
+			os.Remove(infoPath)
+			return removeErr
+		}
+	}
+
+	entry.StoredName = name
+	entry.ID = entryID(destPath)
+	entry.IsCompressed = false
+	entry.Codec = codecNone
+	entry.CodecLevel = 0
+
+	// The checksum is of the trashed copy, so it can only be added now
+	if entry.FileType == fileTypeRegular {
+		if sum, err := payloadSum(destPath, *entry); err == nil {
+			if appendTrashInfo(infoPath, trashInfoChecksumKey, sum) == nil {
+				entry.SHA256 = sum
+			}
+		}
+	}
+
+	if s.byID != nil {
+		s.byID[entry.ID] = trashItem{entry: *entry, storedPath: destPath, infoPath: infoPath}
+	}
+
+	if removeErr != nil {
+		return fmt.Errorf("'%s' is in the trash, but could not be removed completely: %v", originalPath, removeErr)
+	}
+	return nil
+}
+
+func (s *trashStore) Get(id, dst string) error {
+	item, err := s.find(id)
+	if err != nil {
+		return err
+	}
+
+	if err := renameNoReplace(item.storedPath, dst); errors.Is(err, unix.EXDEV) {
+		if err := copyFile(item.storedPath, dst); err != nil {
+			return err
+		}
+		os.RemoveAll(item.storedPath)
+	} else if err != nil {
+		return err
+	}
+
+	delete(s.byID, id)
+	return os.Remove(item.infoPath)
+}
+
+func (s *trashStore) List() ([]RecycleBinEntry, error) {
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	entries := make([]RecycleBinEntry, 0, len(s.byID))
+	for _, item := range s.byID {
+		entries = append(entries, item.entry)
+	}
+
+	sortEntriesByTime(entries)
+	return entries, nil
+}
+
+func (s *trashStore) Delete(id string) error {
+	item, err := s.find(id)
+	if err != nil {
+		return err
+	}
+
+	// The info file goes last so an interrupted delete never leaves an
+	// entry the file manager can't restore
+	if err := os.RemoveAll(item.storedPath); err != nil {
+		return err
+	}
+	delete(s.byID, id)
+	return os.Remove(item.infoPath)
+}
+
+func (s *trashStore) Stat(id string) (RecycleBinEntry, int64, error) {
+	item, err := s.find(id)
+	if err != nil {
+		return RecycleBinEntry{}, 0, err
+	}
+
+	info, err := os.Lstat(item.storedPath)
+	if err != nil {
+		return item.entry, 0, err
+	}
+	if info.IsDir() {
+		return item.entry, getDirSize(item.storedPath), nil
+	}
+	return item.entry, info.Size(), nil
+}
+
+func (s *trashStore) find(id string) (trashItem, error) {
+	if err := s.load(); err != nil {
+		return trashItem{}, err
+	}
+
+	item, ok := s.byID[id]
+	if !ok {
+		return trashItem{}, fmt.Errorf("no entry with ID '%s' in trash", id)
+	}
+	return item, nil
+}
+
+// createTrashInfo atomically claims a unique name in info/ by creating its
+// .trashinfo file with O_EXCL, which is how the spec avoids races between
+// concurrent trashing processes
+func createTrashInfo(infoDir, baseName, contents string) (string, string, error) {
+	ext := filepath.Ext(baseName)
+	stem := strings.TrimSuffix(baseName, ext)
+	if stem == "" {
+		stem, ext = baseName, ""
+	}
+
+	for i := 1; ; i++ {
+		name := baseName
+		if i > 1 {
+			name = fmt.Sprintf("%s.%d%s", stem, i, ext)
+		}
+
+		infoPath := filepath.Join(infoDir, name+".trashinfo")
+		f, err := os.OpenFile(infoPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", "", err
+		}
+
+		if _, err := f.WriteString(contents); err != nil {
+			f.Close()
+			os.Remove(infoPath)
+			return "", "", err
+		}
+		if err := f.Close(); err != nil {
+			os.Remove(infoPath)
+			return "", "", err
+		}
+
+		return name, infoPath, nil
+	}
+}
+
+// load reads the .trashinfo files of every known trash once per process
+func (s *trashStore) load() error {
+	if s.byID != nil {
+		return nil
+	}
+
+	s.byID = make(map[string]trashItem)
+	for _, dir := range knownTrashDirs() {
+		infoDir := filepath.Join(dir.path, "info")
+		entries, err := os.ReadDir(infoDir)
+		if err != nil {
+			continue
+		}
+
+		for _, entry := range entries {
+			if !strings.HasSuffix(entry.Name(), ".trashinfo") {
+				continue
+			}
+
+			infoPath := filepath.Join(infoDir, entry.Name())
+			info, err := readTrashInfo(infoPath)
+			if err != nil {
+				continue
+			}
+			originalPath := info.path
+			if !filepath.IsAbs(originalPath) && dir.topDir != "" {
+				originalPath = filepath.Join(dir.topDir, originalPath)
+			}
+
+			name := strings.TrimSuffix(entry.Name(), ".trashinfo")
+			storedPath := filepath.Join(dir.path, "files", name)
+
+			fileInfo, err := os.Lstat(storedPath)
+			if err != nil {
+				continue
+			}
+
+			size := fileInfo.Size()
+			if fileInfo.IsDir() {
+				size = getDirSize(storedPath)
+			}
+
+			id := entryID(storedPath)
+			s.byID[id] = trashItem{
+				entry: RecycleBinEntry{
+					ID:            id,
+					OriginalPath:  originalPath,
+					DeletedAt:     info.deletedAt,
+					StoredName:    name,
+					OriginalSize:  size,
+					IsDirectory:   fileInfo.IsDir(),
+					TransactionID: info.transactionID,
+					SHA256:        info.sha256,
+				},
+				storedPath: storedPath,
+				infoPath:   infoPath,
+			}
+		}
+	}
+
+	return nil
+}
+
+// appendTrashInfo adds key=value to the .trashinfo file at path
+func appendTrashInfo(path, key, value string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "%s=%s\n", key, value); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// trashInfo holds the keys of a .trashinfo file better-rm understands
+type trashInfo struct {
+	path          string
+	deletedAt     time.Time
+	transactionID string
+	sha256        string
+}
+
+func readTrashInfo(path string) (trashInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return trashInfo{}, err
+	}
+	defer f.Close()
+
+	var info trashInfo
+	inSection := false
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			inSection = line == "[Trash Info]"
+			continue
+		}
+		if !inSection {
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+
+		switch key {
+		case "Path":
+			if info.path, err = url.PathUnescape(value); err != nil {
+				return trashInfo{}, err
+			}
+		case "DeletionDate":
+			info.deletedAt, _ = time.ParseInLocation(trashInfoDateFormat, value, time.Local)
+		case trashInfoTransactionKey:
+			info.transactionID = value
+		case trashInfoChecksumKey:
+			info.sha256 = value
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return trashInfo{}, err
+	}
+	if info.path == "" {
+		return trashInfo{}, fmt.Errorf("%s: missing Path key", path)
+	}
+
+	return info, nil
+}
+
+// escapeTrashPath URL-escapes every path component but keeps the separators
+func escapeTrashPath(path string) string {
+	return (&url.URL{Path: path}).EscapedPath()
+}
@@ -1,3 +1,8 @@
 module better-rm
 
 go 1.24.4
+
+require (
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/sys v0.41.0
+)
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// indexFileName is the append-only metadata log kept in .metadata
+const indexFileName = "index.jsonl"
+
+// compactThreshold is how many superseded records the log may carry before
+// it gets rewritten
+const compactThreshold = 1024
+
+// indexRecord is one line of the index log. Replaying every record in order
+// rebuilds the current set of entries.
+type indexRecord struct {
+	Op    string           `json:"op"` // "put" or "del"
+	ID    string           `json:"id,omitempty"`
+	Entry *RecycleBinEntry `json:"entry,omitempty"`
+}
+
+// binIndex holds every entry of a dirStore in memory, indexed by ID, original
+// path and deletion time, backed by an append-only log on disk
+type binIndex struct {
+	path    string
+	byID    map[string]RecycleBinEntry
+	byPath  map[string][]string // original path -> IDs
+	byName  map[string][]string // base name of original path -> IDs
+	byTime  []string            // IDs ordered by deletion time, oldest first
+	records int                 // records in the log, live or superseded
+	logSize int64               // bytes of the log this process has seen
+}
+
+// openBinIndex loads the index log in metadataDir, folding in any legacy
+// per-entry JSON documents it finds there
+func openBinIndex(metadataDir string) (*binIndex, error) {
+	ix := &binIndex{
+		path:   filepath.Join(metadataDir, indexFileName),
+		byID:   make(map[string]RecycleBinEntry),
+		byPath: make(map[string][]string),
+		byName: make(map[string][]string),
+	}
+
+	if err := ix.replay(); err != nil {
+		return nil, err
+	}
+	ix.sortByTime()
+
+	if err := ix.migrate(metadataDir); err != nil {
+		return nil, err
+	}
+
+	return ix, nil
+}
+
+func (ix *binIndex) replay() error {
+	data, err := os.ReadFile(ix.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// A crash mid-append can leave a torn last line; drop it so the next
+	// append starts on a clean line
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		data = data[:bytes.LastIndexByte(data, '\n')+1]
+		if err := os.Truncate(ix.path, int64(len(data))); err != nil {
+			return err
+		}
+	}
+
+	ix.logSize = int64(len(data))
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record indexRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		ix.records++
+		ix.apply(record)
+	}
+	return scanner.Err()
+}
+
+// migrate moves .metadata/*.json documents written by older versions into the
+// log and removes them once they are safely recorded
+func (ix *binIndex) migrate(metadataDir string) error {
+	dirEntries, err := os.ReadDir(metadataDir)
+	if err != nil {
+		return err
+	}
+
+	var legacy []string
+	var records []indexRecord
+	for _, dirEntry := range dirEntries {
+		if !strings.HasSuffix(dirEntry.Name(), ".json") {
+			continue
+		}
+
+		legacyPath := filepath.Join(metadataDir, dirEntry.Name())
+		data, err := os.ReadFile(legacyPath)
+		if err != nil {
+			continue
+		}
+
+		var entry RecycleBinEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			continue
+		}
+
+		// Entries written before IDs existed get the same ID they would have been given
+		if entry.ID == "" {
+			entry.ID = entryID(entry.StoredName)
+		}
+
+		legacy = append(legacy, legacyPath)
+		records = append(records, indexRecord{Op: "put", Entry: &entry})
+	}
+
+	if len(records) == 0 {
+		return nil
+	}
+
+	if err := ix.append(records...); err != nil {
+		return err
+	}
+	for _, record := range records {
+		ix.apply(record)
+	}
+	ix.sortByTime()
+
+	for _, legacyPath := range legacy {
+		os.Remove(legacyPath)
+	}
+	return nil
+}
+
+func (ix *binIndex) apply(record indexRecord) {
+	switch record.Op {
+	case "put":
+		if record.Entry == nil {
+			return
+		}
+		entry := *record.Entry
+		if _, exists := ix.byID[entry.ID]; exists {
+			ix.unlink(entry.ID)
+		}
+		ix.byID[entry.ID] = entry
+		ix.byPath[entry.OriginalPath] = append(ix.byPath[entry.OriginalPath], entry.ID)
+		name := filepath.Base(entry.OriginalPath)
+		ix.byName[name] = append(ix.byName[name], entry.ID)
+		ix.byTime = append(ix.byTime, entry.ID)
+	case "del":
+		ix.unlink(record.ID)
+	}
+}
+
+func (ix *binIndex) unlink(id string) {
+	entry, ok := ix.byID[id]
+	if !ok {
+		return
+	}
+	delete(ix.byID, id)
+	ix.byPath[entry.OriginalPath] = removeID(ix.byPath[entry.OriginalPath], id)
+	if len(ix.byPath[entry.OriginalPath]) == 0 {
+		delete(ix.byPath, entry.OriginalPath)
+	}
+	name := filepath.Base(entry.OriginalPath)
+	ix.byName[name] = removeID(ix.byName[name], id)
+	if len(ix.byName[name]) == 0 {
+		delete(ix.byName, name)
+	}
+	ix.byTime = removeID(ix.byTime, id)
+}
+
+func removeID(ids []string, id string) []string {
+	for i, candidate := range ids {
+		if candidate == id {
+			return append(ids[:i], ids[i+1:]...)
+		}
+	}
+	return ids
+}
+
+func (ix *binIndex) sortByTime() {
+	sort.SliceStable(ix.byTime, func(i, j int) bool {
+		return ix.byID[ix.byTime[i]].DeletedAt.Before(ix.byID[ix.byTime[j]].DeletedAt)
+	})
+}
+
+// append writes records to the log with a single write and syncs it, so each
+// call is either fully recorded or (after a torn write) ignored on replay
+func (ix *binIndex) append(records ...indexRecord) error {
+	var buf bytes.Buffer
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	f, err := os.OpenFile(ix.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	ix.records += len(records)
+	ix.logSize += int64(buf.Len())
+	return nil
+}
+
+func (ix *binIndex) put(entry RecycleBinEntry) error {
+	record := indexRecord{Op: "put", Entry: &entry}
+	if err := ix.append(record); err != nil {
+		return err
+	}
+
+	ix.apply(record)
+	if n := len(ix.byTime); n > 1 && entry.DeletedAt.Before(ix.byID[ix.byTime[n-2]].DeletedAt) {
+		ix.sortByTime()
+	}
+	return nil
+}
+
+func (ix *binIndex) remove(id string) error {
+	record := indexRecord{Op: "del", ID: id}
+	if err := ix.append(record); err != nil {
+		return err
+	}
+
+	ix.apply(record)
+	if dead := ix.records - len(ix.byID); dead > compactThreshold && dead > len(ix.byID) {
+		return ix.compact()
+	}
+	return nil
+}
+
+// compact rewrites the log with only the live entries, replacing it atomically
+func (ix *binIndex) compact() error {
+	tempPath := ix.path + ".tmp"
+	f, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	for _, entry := range ix.entries() {
+		entry := entry
+		if err := encoder.Encode(indexRecord{Op: "put", Entry: &entry}); err != nil {
+			f.Close()
+			os.Remove(tempPath)
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tempPath)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tempPath)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	if err := os.Rename(tempPath, ix.path); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	ix.records = len(ix.byID)
+	if info, err := os.Stat(ix.path); err == nil {
+		ix.logSize = info.Size()
+	}
+	return nil
+}
+
+// stale reports whether another process has changed the log since this one
+// last read or wrote it
+func (ix *binIndex) stale() bool {
+	info, err := os.Stat(ix.path)
+	if err != nil {
+		return ix.logSize != 0
+	}
+	return info.Size() != ix.logSize
+}
+
+func (ix *binIndex) get(id string) (RecycleBinEntry, bool) {
+	entry, ok := ix.byID[id]
+	return entry, ok
+}
+
+// entries returns every live entry, oldest first
+func (ix *binIndex) entries() []RecycleBinEntry {
+	entries := make([]RecycleBinEntry, 0, len(ix.byTime))
+	for _, id := range ix.byTime {
+		entries = append(entries, ix.byID[id])
+	}
+	return entries
+}
+
+// lookup returns the entries whose original path, or its base name, is name
+func (ix *binIndex) lookup(name string) []RecycleBinEntry {
+	ids := ix.byPath[name]
+	if !filepath.IsAbs(name) {
+		ids = ix.byName[name]
+	}
+
+	entries := make([]RecycleBinEntry, 0, len(ids))
+	for _, id := range ids {
+		entries = append(entries, ix.byID[id])
+	}
+	sortEntriesByTime(entries)
+	return entries
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// legacyEntry is a metadata document as versions before the index log wrote
+// them, one per entry and without an ID
+type legacyEntry struct {
+	OriginalPath string    `json:"original_path"`
+	DeletedAt    time.Time `json:"deleted_at"`
+	StoredName   string    `json:"stored_name"`
+	IsCompressed bool      `json:"is_compressed"`
+	OriginalSize int64     `json:"original_size"`
+	IsDirectory  bool      `json:"is_directory"`
+}
+
+func TestMigrateLegacyMetadata(t *testing.T) {
+	s, base := newTestStore(t)
+
+	deleted := time.Date(2024, 9, 1, 10, 0, 0, 0, time.UTC)
+	var stored []string
+	for i, name := range []string{"a.txt", "b.txt"} {
+		legacy := legacyEntry{
+			OriginalPath: filepath.Join(base, name),
+			DeletedAt:    deleted.Add(time.Duration(i) * time.Hour),
+			StoredName:   fmt.Sprintf("20240901_1%d0000_0000000%d_%s", i, i, name),
+			OriginalSize: int64(len(name)),
+		}
+		data, _ := json.Marshal(legacy)
+		if err := os.WriteFile(filepath.Join(s.metadataDir(), legacy.StoredName+".json"), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(s.root, legacy.StoredName), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+		stored = append(stored, legacy.StoredName)
+	}
+
+	entries, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("migrated %d entries, want 2", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.StoredName != stored[i] {
+			t.Errorf("entry %d is %s, want %s oldest first", i, entry.StoredName, stored[i])
+		}
+		if entry.ID != entryID(entry.StoredName) {
+			t.Errorf("%s got ID %s, want the one derived from its stored name", entry.StoredName, entry.ID)
+		}
+	}
+
+	names, err := os.ReadDir(s.metadataDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if strings.HasSuffix(name.Name(), ".json") {
+			t.Errorf("legacy document %s left behind", name.Name())
+		}
+	}
+
+	// A fresh process finds the entries in the log, once each
+	reopened := &dirStore{root: s.root}
+	entries, err = reopened.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("log holds %d entries after migration, want 2", len(entries))
+	}
+
+	dst := filepath.Join(base, "a.txt")
+	if err := reopened.Get(entries[0].ID, dst); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, dst); got != "a.txt" {
+		t.Errorf("restored file holds %q", got)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// journalFileName is the write-ahead journal of a bin, in .metadata. It holds
+// the steps of the one move into the bin in progress, and is emptied once the
+// move is recorded in the index; anything left in it was cut short by a crash.
+const journalFileName = "journal.jsonl"
+
+// Journal steps of a move into the bin, each logged before it is taken
+const (
+	journalMove   = "move"   // renaming the original to Entry's stored name
+	journalCopy   = "copy"   // copying it there instead, original untouched
+	journalCopied = "copied" // the copy is complete; removing the original
+)
+
+type journalRecord struct {
+	Op    string          `json:"op"`
+	Entry RecycleBinEntry `json:"entry"`
+	// Identify the original, so recovery never removes a file that took its
+	// place after the crash
+	Dev uint64 `json:"dev,omitempty"`
+	Ino uint64 `json:"ino,omitempty"`
+}
+
+// journalOutcome is what recovery did with an interrupted move: with
+// rolledForward the file is in the bin, otherwise it was left where it was
+type journalOutcome struct {
+	entry         RecycleBinEntry
+	rolledForward bool
+}
+
+// recoverer is implemented by stores that journal moves into the bin
+type recoverer interface {
+	// Recover finishes or undoes the moves a crash interrupted
+	Recover() ([]journalOutcome, error)
+}
+
+func (s *dirStore) journalPath() string {
+	return filepath.Join(s.metadataDir(), journalFileName)
+}
+
+// journal logs that step op of moving entry in from originalPath is about to
+// be taken. The record is synced before returning, so the step is never
+// taken unlogged.
+func (s *dirStore) journal(op, originalPath string, entry RecycleBinEntry) error {
+	record := journalRecord{Op: op, Entry: entry}
+	if info, err := os.Lstat(originalPath); err == nil {
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			record.Dev, record.Ino = uint64(stat.Dev), uint64(stat.Ino)
+		}
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.journalPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// clearJournal marks the move in progress as finished, one way or the other
+func (s *dirStore) clearJournal() error {
+	err := os.Truncate(s.journalPath(), 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// lastJournalRecord returns the step the interrupted move last logged
+func (s *dirStore) lastJournalRecord() (journalRecord, bool, error) {
+	data, err := os.ReadFile(s.journalPath())
+	if os.IsNotExist(err) {
+		return journalRecord{}, false, nil
+	}
+	if err != nil {
+		return journalRecord{}, false, err
+	}
+
+	// A torn last line was never synced, so its step was never taken
+	var last journalRecord
+	found := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil || record.Entry.StoredName == "" {
+			continue
+		}
+		last, found = record, true
+	}
+	return last, found, scanner.Err()
+}
+
+// recoverJournal finishes or undoes the move a crash left in the journal.
+// The caller holds the bin lock exclusively, so no live process is
+// still working on it.
+func (s *dirStore) recoverJournal() (*journalOutcome, error) {
+	record, found, err := s.lastJournalRecord()
+	if err != nil || !found {
+		return nil, err
+	}
+
+	entry := record.Entry
+	storedPath := s.storedPath(entry)
+	outcome := &journalOutcome{entry: entry}
+
+	if _, ok := s.index.get(entry.ID); ok {
+		// Recorded already; only emptying the journal was cut short
+		outcome.rolledForward = true
+		return outcome, s.clearJournal()
+	}
+
+	switch record.Op {
+	case journalMove:
+		// The rename either happened or it didn't
+		if _, err := os.Lstat(storedPath); err == nil {
+			outcome.rolledForward = true
+		}
+
+	case journalCopy:
+		// The original is untouched, so a partial copy is simply dropped
+		if err := os.RemoveAll(storedPath); err != nil {
+			return nil, err
+		}
+
+	case journalCopied:
+		// The copy is whole; finish removing what is left of the original
+		if isSameFile(entry.OriginalPath, record.Dev, record.Ino) {
+			if err := os.RemoveAll(entry.OriginalPath); err != nil {
+				return nil, err
+			}
+		}
+		outcome.rolledForward = true
+
+	default:
+		return nil, fmt.Errorf("unknown step '%s' in journal '%s'", record.Op, s.journalPath())
+	}
+
+	if outcome.rolledForward {
+		// As in Put, only a copy is summed right away
+		if entry.FileType == fileTypeRegular {
+			if record.Op == journalMove {
+				entry.PendingChecksum = true
+			} else {
+				entry.SHA256, _ = payloadSum(storedPath, entry)
+			}
+		}
+		if err := s.index.put(entry); err != nil {
+			return nil, err
+		}
+		outcome.entry = entry
+	}
+
+	return outcome, s.clearJournal()
+}
+
+func (s *dirStore) Recover() ([]journalOutcome, error) {
+	// Most runs find nothing to do, and need no lock to see that
+	if info, err := os.Stat(s.journalPath()); err != nil || info.Size() == 0 {
+		return nil, nil
+	}
+
+	unlock, err := s.Lock(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	outcome, err := s.recoverJournal()
+	if outcome == nil {
+		return nil, err
+	}
+	return []journalOutcome{*outcome}, err
+}
+
+func (s *mountStore) Recover() ([]journalOutcome, error) {
+	var outcomes []journalOutcome
+	var firstErr error
+	for _, bin := range s.discover() {
+		binOutcomes, err := bin.Recover()
+		outcomes = append(outcomes, binOutcomes...)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return outcomes, firstErr
+}
+
+// recoverInterruptedMoves settles moves into the bin that a crash cut short,
+// so no deleted file is left without an entry
+func recoverInterruptedMoves() {
+	config, err := loadRecycleBinConfig()
+	if err != nil {
+		return
+	}
+
+	r, ok := openStore(config).(recoverer)
+	if !ok {
+		return
+	}
+
+	outcomes, err := r.Recover()
+	for _, outcome := range outcomes {
+		path := outcome.entry.OriginalPath
+		if outcome.rolledForward {
+			out.notice(outputRecord{Type: "interrupted_move", Action: "rolled_forward", Path: path, ID: outcome.entry.ID},
+				"rm: finished moving '%s' to the recycle bin after an interrupted run\n", path)
+		} else {
+			out.notice(outputRecord{Type: "interrupted_move", Action: "rolled_back", Path: path},
+				"rm: '%s' was left in place by an interrupted run\n", path)
+		}
+	}
+	if err != nil {
+		message := fmt.Sprintf("cannot recover interrupted moves into the recycle bin: %v", err)
+		out.fail(outputError{Code: errorCode(err), Message: message}, "rm: %s\n", message)
+	}
+}
+
+// isSameFile reports whether path is still the file with inode ino on dev
+func isSameFile(path string, dev, ino uint64) bool {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && uint64(stat.Dev) == dev && uint64(stat.Ino) == ino
+}
+
+// syncFile flushes the file at path to disk; directories are left as they are
+func syncFile(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
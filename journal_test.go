@@ -0,0 +1,198 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// journaledEntry sets up the entry Put would journal for moving path in
+func journaledEntry(t *testing.T, s *dirStore, path string) RecycleBinEntry {
+	t.Helper()
+	if err := s.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	entry := RecycleBinEntry{
+		OriginalPath: path,
+		DeletedAt:    time.Now(),
+		OriginalSize: int64(len("deleted")),
+		FileType:     fileTypeRegular,
+		Codec:        codecNone,
+	}
+	entry.StoredName = s.storedName(entry)
+	entry.ID = entryID(entry.StoredName)
+	return entry
+}
+
+// recoverOne replays the journal as a fresh process would, and returns what
+// it did with the one interrupted move
+func recoverOne(t *testing.T, root string) (*dirStore, journalOutcome) {
+	t.Helper()
+	s := &dirStore{root: root}
+	outcomes, err := s.Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outcomes) != 1 {
+		t.Fatalf("recovered %d moves, want 1", len(outcomes))
+	}
+
+	if info, err := os.Stat(s.journalPath()); err != nil || info.Size() != 0 {
+		t.Fatalf("journal not emptied after recovery: %v", err)
+	}
+	return s, outcomes[0]
+}
+
+func readString(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRecoverMoveRollsForward(t *testing.T) {
+	s, base := newTestStore(t)
+	original := filepath.Join(base, "item")
+	os.WriteFile(original, []byte("deleted"), 0644)
+
+	// The crash came after the rename, before the index was written
+	entry := journaledEntry(t, s, original)
+	if err := s.journal(journalMove, original, entry); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(original, s.storedPath(entry)); err != nil {
+		t.Fatal(err)
+	}
+
+	s, outcome := recoverOne(t, s.root)
+	if !outcome.rolledForward {
+		t.Fatal("move with the file in the bin was rolled back")
+	}
+	recorded, err := s.find(entry.ID)
+	if err != nil {
+		t.Fatalf("entry not recorded: %v", err)
+	}
+	if !recorded.PendingChecksum {
+		t.Error("renamed file not left for compaction to sum")
+	}
+	if got := readString(t, s.storedPath(recorded)); got != "deleted" {
+		t.Errorf("stored file holds %q", got)
+	}
+}
+
+func TestRecoverMoveRollsBack(t *testing.T) {
+	s, base := newTestStore(t)
+	original := filepath.Join(base, "item")
+	os.WriteFile(original, []byte("deleted"), 0644)
+
+	// The crash came before the rename
+	entry := journaledEntry(t, s, original)
+	if err := s.journal(journalMove, original, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	s, outcome := recoverOne(t, s.root)
+	if outcome.rolledForward {
+		t.Fatal("move that never happened was rolled forward")
+	}
+	if _, err := s.find(entry.ID); err == nil {
+		t.Error("entry recorded for a file still in place")
+	}
+	if got := readString(t, original); got != "deleted" {
+		t.Errorf("original holds %q", got)
+	}
+}
+
+func TestRecoverCopyRollsBack(t *testing.T) {
+	s, base := newTestStore(t)
+	original := filepath.Join(base, "item")
+	os.WriteFile(original, []byte("deleted"), 0644)
+
+	// The crash came halfway through the copy, and the record for the next
+	// step was torn
+	entry := journaledEntry(t, s, original)
+	s.journal(journalMove, original, entry)
+	if err := s.journal(journalCopy, original, entry); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(s.storedPath(entry), []byte("del"), 0600)
+	f, err := os.OpenFile(s.journalPath(), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"copied","entry":{"orig`)
+	f.Close()
+
+	s, outcome := recoverOne(t, s.root)
+	if outcome.rolledForward {
+		t.Fatal("partial copy was rolled forward")
+	}
+	if _, err := os.Lstat(s.storedPath(entry)); !os.IsNotExist(err) {
+		t.Errorf("partial copy left in the bin: %v", err)
+	}
+	if got := readString(t, original); got != "deleted" {
+		t.Errorf("original holds %q", got)
+	}
+}
+
+func TestRecoverCopiedRollsForward(t *testing.T) {
+	s, base := newTestStore(t)
+	original := filepath.Join(base, "item")
+	os.WriteFile(original, []byte("deleted"), 0644)
+
+	// The crash came after the copy was whole, before the original went
+	entry := journaledEntry(t, s, original)
+	s.journal(journalCopy, original, entry)
+	if err := copyFile(original, s.storedPath(entry)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.journal(journalCopied, original, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	s, outcome := recoverOne(t, s.root)
+	if !outcome.rolledForward {
+		t.Fatal("whole copy was rolled back")
+	}
+	if _, err := os.Lstat(original); !os.IsNotExist(err) {
+		t.Errorf("original not removed: %v", err)
+	}
+	recorded, err := s.find(entry.ID)
+	if err != nil {
+		t.Fatalf("entry not recorded: %v", err)
+	}
+	if recorded.SHA256 == "" || recorded.PendingChecksum {
+		t.Error("copied file not summed during recovery")
+	}
+}
+
+// TestRecoverCopiedKeepsReplacement checks that a file put where the
+// original was after the crash is not taken for what is left of it
+func TestRecoverCopiedKeepsReplacement(t *testing.T) {
+	s, base := newTestStore(t)
+	original := filepath.Join(base, "item")
+	os.WriteFile(original, []byte("deleted"), 0644)
+
+	entry := journaledEntry(t, s, original)
+	if err := copyFile(original, s.storedPath(entry)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.journal(journalCopied, original, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	replacement := filepath.Join(base, "new")
+	os.WriteFile(replacement, []byte("new"), 0644)
+	if err := os.Rename(replacement, original); err != nil {
+		t.Fatal(err)
+	}
+
+	recoverOne(t, s.root)
+	if got := readString(t, original); got != "new" {
+		t.Errorf("replacement was removed or changed: %q", got)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockFileName is flocked by every process using a bin, in .metadata:
+// shared while reading the index, exclusive while changing the bin
+const lockFileName = "lock"
+
+// locker is implemented by stores that several processes can use at once
+type locker interface {
+	// Lock holds the store shared, for reading, or exclusively, for changes,
+	// until the returned function is called. Locks nest within a process.
+	Lock(exclusive bool) (func(), error)
+}
+
+// lockStore locks store if it supports locking
+func lockStore(store Store, exclusive bool) (func(), error) {
+	if l, ok := store.(locker); ok {
+		return l.Lock(exclusive)
+	}
+	return func() {}, nil
+}
+
+func (s *dirStore) Lock(exclusive bool) (func(), error) {
+	if s.lockDepth == 0 {
+		f, err := os.OpenFile(filepath.Join(s.metadataDir(), lockFileName), os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		s.lockFile = f
+	}
+
+	// A nested exclusive lock upgrades a shared one for the rest of the outer hold
+	if s.lockDepth == 0 || exclusive && !s.lockExclusive {
+		how := unix.LOCK_SH
+		if exclusive {
+			how = unix.LOCK_EX
+		}
+		if err := flock(s.lockFile, how); err != nil {
+			if s.lockDepth == 0 {
+				s.lockFile.Close()
+				s.lockFile = nil
+			}
+			return nil, err
+		}
+		s.lockExclusive = exclusive
+
+		// Another process may have changed the index while we waited
+		if s.index != nil && s.index.stale() {
+			s.index = nil
+		}
+	}
+
+	s.lockDepth++
+	return func() {
+		s.lockDepth--
+		if s.lockDepth == 0 {
+			s.lockFile.Close()
+			s.lockFile = nil
+			s.lockExclusive = false
+		}
+	}, nil
+}
+
+// Lock locks every bin that can currently be found, always in the same order
+// so processes locking several bins can't deadlock. Volume bins that can't be
+// locked are left out, as they are when listing.
+func (s *mountStore) Lock(exclusive bool) (func(), error) {
+	var unlocks []func()
+	unlockAll := func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+
+	for _, bin := range s.discover() {
+		unlock, err := bin.Lock(exclusive)
+		if err != nil {
+			if bin == s.home {
+				unlockAll()
+				return nil, err
+			}
+			continue
+		}
+		unlocks = append(unlocks, unlock)
+	}
+	return unlockAll, nil
+}
+
+// flock waits for lock operation how on f
+func flock(f *os.File, how int) error {
+	for {
+		err := unix.Flock(int(f.Fd()), how)
+		if err != unix.EINTR {
+			if err != nil {
+				return &os.PathError{Op: "flock", Path: f.Name(), Err: err}
+			}
+			return nil
+		}
+	}
+}
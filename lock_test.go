@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// stressBin is a better-rm binary and a private HOME with a bin set up
+type stressBin struct {
+	t    *testing.T
+	exe  string
+	home string
+}
+
+func newStressBin(t *testing.T) *stressBin {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("builds and runs the binary")
+	}
+
+	dir := t.TempDir()
+	exe := filepath.Join(dir, "rm")
+	if output, err := exec.Command("go", "build", "-o", exe, ".").CombinedOutput(); err != nil {
+		t.Fatalf("go build: %v\n%s", err, output)
+	}
+
+	home := filepath.Join(dir, "home")
+	config := RecycleBinConfig{
+		Version:          version,
+		RecycleBinPath:   filepath.Join(home, ".local", "share", "better-rm", "recycle-bin"),
+		RetentionDays:    7,
+		Backend:          backendBetterRM,
+		OversizePolicy:   oversizeRefuse,
+		Codec:            codecGzip,
+		ManualCompaction: true, // no background passes outliving the test
+	}
+	data, _ := json.Marshal(config)
+	configPath := filepath.Join(home, ".config", "better-rm", "config.json")
+	if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(configPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return &stressBin{t: t, exe: exe, home: home}
+}
+
+// run runs the binary with args and returns its stdout
+func (b *stressBin) run(args ...string) ([]byte, error) {
+	cmd := exec.Command(b.exe, args...)
+	cmd.Env = append(os.Environ(), "HOME="+b.home, "XDG_DATA_HOME=")
+	output, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		err = fmt.Errorf("%v: %s", err, exitErr.Stderr)
+	}
+	return output, err
+}
+
+// document runs a command with --output=json and decodes its result
+func (b *stressBin) document(args ...string) jsonDocument {
+	b.t.Helper()
+	output, err := b.run(append(args, "--output=json")...)
+	var doc jsonDocument
+	if jsonErr := json.Unmarshal(output, &doc); jsonErr != nil {
+		b.t.Fatalf("rm %v: %v, output %q (%v)", args, jsonErr, output, err)
+	}
+	return doc
+}
+
+// entries lists the bin as original path -> IDs
+func (b *stressBin) entries() map[string][]string {
+	b.t.Helper()
+	doc := b.document("--list-recycle-bin")
+	entries := make(map[string][]string)
+	for _, record := range doc.Records {
+		if record.Type == "entry" {
+			entries[record.Entry.OriginalPath] = append(entries[record.Entry.OriginalPath], record.ID)
+		}
+	}
+	return entries
+}
+
+func writeFiles(t *testing.T, paths ...string) {
+	t.Helper()
+	for _, path := range paths {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestConcurrentProcesses runs deletes, restores and a clear against one bin
+// from many processes at once, then checks that the index and the stored
+// files agree
+func TestConcurrentProcesses(t *testing.T) {
+	const (
+		deleters = 40 // each deletes the same path several times
+		repeats  = 3
+		restores = 15
+		clears   = 15
+	)
+
+	b := newStressBin(t)
+	work := t.TempDir()
+
+	// Entries for the restorers and the clear to work on
+	var restorePaths, clearPaths []string
+	for i := 0; i < restores; i++ {
+		restorePaths = append(restorePaths, filepath.Join(work, "restore", fmt.Sprintf("r%d", i)))
+	}
+	for i := 0; i < clears; i++ {
+		clearPaths = append(clearPaths, filepath.Join(work, "clear", fmt.Sprintf("c%d", i)))
+	}
+	writeFiles(t, append(restorePaths, clearPaths...)...)
+	if _, err := b.run(append(restorePaths, clearPaths...)...); err != nil {
+		t.Fatalf("seeding the bin: %v", err)
+	}
+	seeded := b.entries()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, deleters*repeats+restores+1)
+
+	for i := 0; i < deleters; i++ {
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+			// The same path deleted again within a second needs a new name
+			for n := 0; n < repeats; n++ {
+				if err := os.WriteFile(path, []byte(path), 0644); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := b.run(path); err != nil {
+					errs <- fmt.Errorf("rm %s: %v", path, err)
+				}
+			}
+		}(filepath.Join(work, fmt.Sprintf("same%d.txt", i)))
+	}
+
+	for _, path := range restorePaths {
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+			if _, err := b.run("--restore-id=" + seeded[path][0]); err != nil {
+				errs <- fmt.Errorf("restore %s: %v", path, err)
+			}
+		}(path)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := b.run("--clear-recycle-bin", "-f", "--path-prefix="+filepath.Join(work, "clear")); err != nil {
+			errs <- fmt.Errorf("clear: %v", err)
+		}
+	}()
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	entries := b.entries()
+	seen := make(map[string]bool)
+	count := 0
+	for path, ids := range entries {
+		for _, id := range ids {
+			if seen[id] {
+				t.Errorf("ID %s is used by more than one entry", id)
+			}
+			seen[id] = true
+			count++
+		}
+		if len(ids) != repeats {
+			t.Errorf("%s has %d entries, want %d", path, len(ids), repeats)
+		}
+	}
+	if count != deleters*repeats {
+		t.Errorf("bin holds %d entries, want %d", count, deleters*repeats)
+	}
+
+	for _, path := range restorePaths {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s was not restored: %v", path, err)
+		}
+	}
+
+	verify := b.document("--verify-recycle-bin")
+	if !verify.OK || verify.Summary["orphaned"] != 0 || verify.Summary["missing"] != 0 || verify.Summary["corrupt"] != 0 {
+		t.Errorf("verify found problems: %+v", verify)
+	}
+	if verify.Summary["entries"] != deleters*repeats {
+		t.Errorf("verify checked %d entries, want %d", verify.Summary["entries"], deleters*repeats)
+	}
+}
@@ -2,12 +2,10 @@ package main
 
 import (
 	"bufio"
-	"compress/gzip"
-	"crypto/md5"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -15,44 +13,76 @@ import (
 	"strings"
 	"syscall"
 	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 const version = "1.0.0"
 
 // Config holds all command-line options and flags
 type Config struct {
-	force           bool
-	interactive     string
-	interactiveFlag bool
-	interactiveOnce bool
-	recursive       bool
-	dir             bool
-	verbose         bool
-	oneFileSystem   bool
-	preserveRoot    bool
-	preserveRootAll bool
-	noPreserveRoot  bool
-	showHelp        bool
-	showVersion     bool
-	useRecycleBin   bool
-	permanentDelete bool
-	clearRecycleBin bool
-	listRecycleBin  bool
-	restoreFile     string
-	recycleBinDays  int
-	setupRecycleBin bool
-	files           []string
+	force             bool
+	interactive       string
+	interactiveFlag   bool
+	interactiveOnce   bool
+	recursive         bool
+	dir               bool
+	verbose           bool
+	oneFileSystem     bool
+	preserveRoot      bool
+	preserveRootAll   bool
+	noPreserveRoot    bool
+	showHelp          bool
+	showVersion       bool
+	useRecycleBin     bool
+	permanentDelete   bool
+	dryRun            bool
+	clearRecycleBin   bool
+	compactRecycleBin bool
+	verifyRecycleBin  bool
+	repairRecycleBin  bool
+	listRecycleBin    bool
+	restoreFile       string
+	restoreID         string
+	restoreMatching   bool
+	restore           restoreOptions
+	query             entryQuery
+	undo              bool
+	undoTxID          string
+	transactionID     string
+	recycleBinDays    int
+	jobs              int
+	setupRecycleBin   bool
+	files             []string
 }
 
 // RecycleBinEntry represents a deleted file/directory in the recycle bin
 type RecycleBinEntry struct {
-	OriginalPath   string    `json:"original_path"`
-	DeletedAt      time.Time `json:"deleted_at"`
-	StoredName     string    `json:"stored_name"`
-	IsCompressed   bool      `json:"is_compressed"`
-	OriginalSize   int64     `json:"original_size"`
-	CompressedSize int64     `json:"compressed_size,omitempty"`
-	IsDirectory    bool      `json:"is_directory"`
+	ID             string     `json:"id"`
+	OriginalPath   string     `json:"original_path"`
+	DeletedAt      time.Time  `json:"deleted_at"`
+	StoredName     string     `json:"stored_name"`
+	IsCompressed   bool       `json:"is_compressed"`
+	Codec          string     `json:"codec,omitempty"` // see codecs; empty for entries that predate them
+	CodecLevel     int        `json:"codec_level,omitempty"`
+	IsArchive      bool       `json:"is_archive,omitempty"` // directory stored as a tar archive
+	Blob           string     `json:"blob,omitempty"`       // SHA-256 of the shared blob holding the payload
+	SHA256         string     `json:"sha256,omitempty"`     // of the original file contents
+	OriginalSize   int64      `json:"original_size"`
+	CompressedSize int64      `json:"compressed_size,omitempty"`
+	IsDirectory    bool       `json:"is_directory"`
+	TransactionID  string     `json:"transaction_id,omitempty"`
+	Attrs          *FileAttrs `json:"attrs,omitempty"`
+	FileType       string     `json:"file_type,omitempty"`
+	LinkTarget     string     `json:"link_target,omitempty"`
+	DeviceMajor    uint32     `json:"device_major,omitempty"`
+	DeviceMinor    uint32     `json:"device_minor,omitempty"`
+	// PendingCompression marks a file stored as-is by a fast delete and
+	// still to be compressed by the next compaction pass
+	PendingCompression bool `json:"pending_compression,omitempty"`
+	// PendingChecksum marks a file renamed into the bin whose SHA256 is
+	// still to be recorded by the next compaction pass
+	PendingChecksum bool `json:"pending_checksum,omitempty"`
 }
 
 // RecycleBinConfig stores user preferences for the recycle bin
@@ -60,7 +90,23 @@ type RecycleBinConfig struct {
 	Version        string `json:"version"`
 	RecycleBinPath string `json:"recycle_bin_path"`
 	RetentionDays  int    `json:"retention_days"`
-	MaxSizeMB      int64  `json:"max_size_mb"`
+	MaxSizeMB      int64  `json:"max_size_mb"`               // 0 for no limit
+	Backend        string `json:"backend,omitempty"`         // "better-rm" (default) or "freedesktop"
+	OversizePolicy string `json:"oversize_policy,omitempty"` // "refuse" (default), "prompt" or "permanent"
+	// ManualCompaction leaves pending files for --compact-recycle-bin
+	// instead of compressing them in the background after each rm
+	ManualCompaction bool `json:"manual_compaction,omitempty"`
+	// Codec ("gzip", "zstd" or "none") and CodecLevel (0 for the codec's
+	// default) are used for files whose extension isn't in SkipExtensions
+	// and, with SkipHighEntropy, whose contents don't look compressed already
+	Codec           string   `json:"codec,omitempty"`
+	CodecLevel      int      `json:"codec_level,omitempty"`
+	SkipExtensions  []string `json:"skip_extensions,omitempty"`
+	SkipHighEntropy bool     `json:"skip_high_entropy,omitempty"`
+	// ArchiveDirectories stores directories as compressed tar archives
+	ArchiveDirectories bool `json:"archive_directories,omitempty"`
+	// Dedup stores identical file contents once, shared between entries
+	Dedup bool `json:"dedup,omitempty"`
 }
 
 func main() {
@@ -81,37 +127,93 @@ func main() {
 		return
 	}
 
-	if err := initRecycleBin(); err != nil {
-		fmt.Fprintf(os.Stderr, "rm: failed to initialize recycle bin: %v\n", err)
-		os.Exit(1)
+	out.command = commandName(config)
+	defer out.finish()
+
+	// A dry run must not touch the disk, not even to create the recycle bin
+	if !config.dryRun {
+		if err := initRecycleBin(); err != nil {
+			message := fmt.Sprintf("failed to initialize recycle bin: %v", err)
+			out.fail(outputError{Code: codeConfig, Message: message}, "rm: %s\n", message)
+			out.exit(1)
+		}
+		recoverInterruptedMoves()
 	}
 
 	if config.clearRecycleBin {
-		clearRecycleBin()
+		clearRecycleBin(config.query, config.force)
 		return
 	}
 
 	if config.listRecycleBin {
-		listRecycleBin()
+		listRecycleBin(config.query)
+		return
+	}
+
+	if config.compactRecycleBin {
+		compactRecycleBin()
+		return
+	}
+
+	if config.verifyRecycleBin {
+		verifyRecycleBin()
+		return
+	}
+
+	if config.repairRecycleBin {
+		repairRecycleBin(config.dryRun)
+		return
+	}
+
+	// Files restores overwrite go to the bin together, as one transaction
+	config.restore.txID = newTransactionID()
+
+	if config.restoreID != "" {
+		restoreByID(config.restoreID, config.restore)
+		return
+	}
+
+	if config.undo {
+		undoTransaction(config.undoTxID, config.restore)
 		return
 	}
 
 	if config.restoreFile != "" {
-		restoreFromRecycleBin(config.restoreFile)
+		restoreFromRecycleBin(config.restoreFile, config.query, config.restore)
 		return
 	}
 
-	cleanupRecycleBin() // Remove old files from recycle bin
+	if config.restoreMatching {
+		if !config.query.filtered() {
+			usageError(false, "--restore needs a PATH or at least one filter, such as --txid or --deleted-after")
+		}
+		restoreMatching(config.query, config.restore)
+		return
+	}
+
+	if config.restore.to != "" || config.restore.onConflict != "" {
+		usageError(false, "--restore-to and --on-conflict only apply to --restore, --restore-id and --undo")
+	}
+
+	// Filters never narrow what rm itself removes
+	if config.query.used() {
+		usageError(false, "filter and sort options only apply to --list-recycle-bin, --restore and --clear-recycle-bin")
+	}
+
+	if !config.dryRun {
+		cleanupRecycleBin() // Remove old files from recycle bin
+	}
+
+	// Everything this invocation moves into the bin can be undone as one unit
+	config.transactionID = newTransactionID()
 
 	if len(config.files) == 0 {
-		fmt.Fprintf(os.Stderr, "rm: missing operand\n")
-		fmt.Fprintf(os.Stderr, "Try 'rm --help' for more information.\n")
-		os.Exit(1)
+		usageError(true, "missing operand")
 	}
 
 	if err := validateRootProtection(config); err != nil {
-		fmt.Fprintf(os.Stderr, "rm: %v\n", err)
-		os.Exit(1)
+		out.fail(errorFor(err, ""), "rm: %v\n", err)
+		out.exit(1)
 	}
 
 	if shouldPromptOnce(config) {
@@ -120,14 +222,47 @@ func main() {
 		}
 	}
 
+	// The dry-run report takes the place of the verbose messages
+	if config.dryRun {
+		config.verbose = false
+	}
+
 	// Process each file/directory
 	for _, file := range config.files {
 		if err := removeFile(file, config); err != nil {
 			if !config.force {
-				fmt.Fprintf(os.Stderr, "rm: %v\n", err)
+				out.fail(errorFor(err, file), "rm: %v\n", err)
 			}
 		}
 	}
+
+	if config.useRecycleBin && !config.permanentDelete && !config.dryRun {
+		startBackgroundCompaction()
+	}
+}
+
+// commandName names the command config selects, as reported in JSON output.
+// The order follows the dispatch in main.
+func commandName(config Config) string {
+	switch {
+	case config.clearRecycleBin:
+		return "clear"
+	case config.listRecycleBin:
+		return "list"
+	case config.compactRecycleBin:
+		return "compact"
+	case config.verifyRecycleBin:
+		return "verify"
+	case config.repairRecycleBin:
+		return "repair"
+	case config.restoreID != "":
+		return "restore"
+	case config.undo:
+		return "undo"
+	case config.restoreFile != "", config.restoreMatching:
+		return "restore"
+	}
+	return "remove"
 }
 
 func parseArgs() Config {
@@ -136,11 +271,24 @@ func parseArgs() Config {
 		preserveRoot:   true,
 		useRecycleBin:  true,
 		recycleBinDays: 7,
+		jobs:           runtime.NumCPU(),
+		query:          newEntryQuery(),
 	}
 
 	args := os.Args[1:]
 	var files []string
 
+	// The output format is picked out first, so even a bad argument before
+	// it is reported in that format
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if value, ok := strings.CutPrefix(arg, "--output="); ok && isOutputFormat(value) {
+			out.format = value
+		}
+	}
+
 	for i := 0; i < len(args); i++ {
 		arg := args[i]
 
@@ -177,8 +325,7 @@ func parseArgs() Config {
 				case "always":
 					config.interactive = "always"
 				default:
-					fmt.Fprintf(os.Stderr, "rm: invalid argument '%s' for '--interactive'\n", parts[1])
-					os.Exit(1)
+					usageError(false, "invalid argument '%s' for '--interactive'", parts[1])
 				}
 			}
 		case arg == "-r" || arg == "-R" || arg == "--recursive":
@@ -207,23 +354,69 @@ func parseArgs() Config {
 		case arg == "--permanent":
 			config.permanentDelete = true
 			config.useRecycleBin = false
+		case arg == "--dry-run":
+			config.dryRun = true
 		case arg == "--clear-recycle-bin":
 			config.clearRecycleBin = true
+		case arg == "--compact-recycle-bin":
+			config.compactRecycleBin = true
+		case arg == "--verify-recycle-bin":
+			config.verifyRecycleBin = true
+		case arg == "--repair-recycle-bin":
+			config.repairRecycleBin = true
 		case arg == "--list-recycle-bin":
 			config.listRecycleBin = true
 		case arg == "--setup-recycle-bin":
 			config.setupRecycleBin = true
+		case arg == "--restore":
+			config.restoreMatching = true
 		case strings.HasPrefix(arg, "--restore="):
 			parts := strings.SplitN(arg, "=", 2)
 			config.restoreFile = parts[1]
+		case strings.HasPrefix(arg, "--restore-id="):
+			parts := strings.SplitN(arg, "=", 2)
+			config.restoreID = parts[1]
+		case strings.HasPrefix(arg, "--restore-to="):
+			parts := strings.SplitN(arg, "=", 2)
+			if parts[1] == "" {
+				usageError(false, "option '--restore-to' requires an argument")
+			}
+			config.restore.to = parts[1]
+		case strings.HasPrefix(arg, "--on-conflict="):
+			parts := strings.SplitN(arg, "=", 2)
+			if !isConflictPolicy(parts[1]) {
+				usageError(false, "invalid argument '%s' for '--on-conflict' (use ask, overwrite, rename or skip)", parts[1])
+			}
+			config.restore.onConflict = parts[1]
+		case arg == "--undo":
+			config.undo = true
+		case strings.HasPrefix(arg, "--undo="):
+			parts := strings.SplitN(arg, "=", 2)
+			config.undo = true
+			config.undoTxID = parts[1]
+		case strings.HasPrefix(arg, "--jobs="):
+			parts := strings.SplitN(arg, "=", 2)
+			jobs, err := strconv.Atoi(parts[1])
+			if err != nil || jobs < 1 {
+				usageError(false, "invalid number of jobs '%s'", parts[1])
+			}
+			config.jobs = jobs
 		case strings.HasPrefix(arg, "--recycle-bin-days="):
 			parts := strings.SplitN(arg, "=", 2)
 			days, err := strconv.Atoi(parts[1])
 			if err != nil || days < 1 {
-				fmt.Fprintf(os.Stderr, "rm: invalid retention days '%s'\n", parts[1])
-				os.Exit(1)
+				usageError(false, "invalid retention days '%s'", parts[1])
 			}
 			config.recycleBinDays = days
+		case strings.HasPrefix(arg, "--output="):
+			parts := strings.SplitN(arg, "=", 2)
+			if !isOutputFormat(parts[1]) {
+				usageError(false, "invalid argument '%s' for '--output' (use table, json or ndjson)", parts[1])
+			}
+		case isQueryOption(arg):
+			if err := config.query.set(arg); err != nil {
+				usageError(false, "%v", err)
+			}
 		case strings.HasPrefix(arg, "-") && len(arg) > 1:
 
 			for j := 1; j < len(arg); j++ {
@@ -243,15 +436,11 @@ func parseArgs() Config {
 				case 'v':
 					config.verbose = true
 				default:
-					fmt.Fprintf(os.Stderr, "rm: invalid option -- '%c'\n", arg[j])
-					fmt.Fprintf(os.Stderr, "Try 'rm --help' for more information.\n")
-					os.Exit(1)
+					usageError(true, "invalid option -- '%c'", arg[j])
 				}
 			}
 		default:
-			fmt.Fprintf(os.Stderr, "rm: unrecognized option '%s'\n", arg)
-			fmt.Fprintf(os.Stderr, "Try 'rm --help' for more information.\n")
-			os.Exit(1)
+			usageError(true, "unrecognized option '%s'", arg)
 		}
 	}
 
@@ -273,7 +462,7 @@ func validateRootProtection(config Config) error {
 
 		if absPath == "/" {
 			if config.preserveRoot {
-				return fmt.Errorf("it is dangerous to operate recursively on '/'")
+				return withCode(codeRootProtected, fmt.Errorf("it is dangerous to operate recursively on '/'"))
 			}
 		}
 
@@ -281,13 +470,13 @@ func validateRootProtection(config Config) error {
 
 			parentPath := filepath.Dir(absPath)
 			if isOnDifferentDevice(absPath, parentPath) {
-				return fmt.Errorf("skipping '%s', since it's on a different device", file)
+				return withCode(codeRootProtected, fmt.Errorf("skipping '%s', since it's on a different device", file))
 			}
 		}
 
 		base := filepath.Base(file)
 		if base == "." || base == ".." {
-			return fmt.Errorf("refusing to remove '.' or '..' directory: skipping '%s'", file)
+			return withCode(codeRootProtected, fmt.Errorf("refusing to remove '.' or '..' directory: skipping '%s'", file))
 		}
 	}
 
@@ -310,7 +499,13 @@ func promptOnce(config Config) bool {
 		operation = fmt.Sprintf("remove %d arguments", len(config.files))
 	}
 
-	fmt.Printf("rm: %s? ", operation)
+	if config.dryRun {
+		out.emit(outputRecord{Type: "prompt", DryRun: true, Message: "rm: " + operation + "?"},
+			"would prompt once: 'rm: %s?'\n", operation)
+		return true
+	}
+
+	out.message("rm: %s? ", operation)
 	return getYesNo()
 }
 
@@ -321,7 +516,7 @@ func removeFile(path string, config Config) error {
 		if os.IsNotExist(err) && config.force {
 			return nil
 		}
-		return fmt.Errorf("cannot remove '%s': %v", path, err)
+		return fmt.Errorf("cannot remove '%s': %w", path, err)
 	}
 
 	if info.IsDir() {
@@ -333,162 +528,204 @@ func removeFile(path string, config Config) error {
 
 func removeRegularFile(path string, info os.FileInfo, config Config) error {
 
-	if shouldPromptForFile(path, info, config) {
-		fmt.Printf("rm: remove %s '%s'? ", getFileType(info), path)
-		if !getYesNo() {
+	prompted := shouldPromptForFile(path, info, config)
+	if prompted {
+		if !ask(config, fmt.Sprintf("rm: remove %s '%s'? ", getFileType(info), path)) {
 			return nil
 		}
 	}
 
+	// JSON output reports the removal once it is done, see recyclePath
 	if config.verbose {
 		if config.useRecycleBin && !config.permanentDelete {
-			fmt.Printf("moved to recycle bin '%s'\n", path)
+			out.text("moved to recycle bin '%s'\n", path)
 		} else {
-			fmt.Printf("removed '%s'\n", path)
+			out.text("removed '%s'\n", path)
 		}
 	}
 
 	if config.useRecycleBin && !config.permanentDelete {
-		return moveToRecycleBin(path)
+		return recyclePath(path, info, prompted, config)
 	}
 
-	return os.Remove(path)
+	return unlinkPath(path, info, prompted, config)
 }
 
 func removeDirectory(path string, info os.FileInfo, config Config) error {
 
 	if !config.recursive && !config.dir {
-		return fmt.Errorf("cannot remove '%s': Is a directory", path)
+		return withCode(codeIsDirectory, fmt.Errorf("cannot remove '%s': Is a directory", path))
 	}
 
 	if config.dir && !config.recursive {
 		if !isDirEmpty(path) {
-			return fmt.Errorf("cannot remove '%s': Directory not empty", path)
+			return withCode(codeNotEmpty, fmt.Errorf("cannot remove '%s': Directory not empty", path))
 		}
 
-		if shouldPromptForFile(path, info, config) {
-			fmt.Printf("rm: remove directory '%s'? ", path)
-			if !getYesNo() {
+		prompted := shouldPromptForFile(path, info, config)
+		if prompted {
+			if !ask(config, fmt.Sprintf("rm: remove directory '%s'? ", path)) {
 				return nil
 			}
 		}
 
 		if config.verbose {
 			if config.useRecycleBin && !config.permanentDelete {
-				fmt.Printf("moved to recycle bin directory '%s'\n", path)
+				out.text("moved to recycle bin directory '%s'\n", path)
 			} else {
-				fmt.Printf("removed directory '%s'\n", path)
+				out.text("removed directory '%s'\n", path)
 			}
 		}
 
 		if config.useRecycleBin && !config.permanentDelete {
-			return moveToRecycleBin(path)
+			return recyclePath(path, info, prompted, config)
 		}
 
-		return os.Remove(path)
+		return unlinkPath(path, info, prompted, config)
 	}
 
 	if config.recursive {
 		return removeRecursively(path, config)
 	}
 
-	return fmt.Errorf("cannot remove '%s': Is a directory", path)
+	return withCode(codeIsDirectory, fmt.Errorf("cannot remove '%s': Is a directory", path))
 }
 
 func removeRecursively(path string, config Config) error {
 
-	if config.oneFileSystem {
-		if err := checkSameFileSystem(path, config); err != nil {
-			return err
-		}
-	}
-
 	info, err := os.Lstat(path)
 	if err != nil {
 		return err
 	}
 
-	if shouldPromptForFile(path, info, config) {
-		fmt.Printf("rm: descend into directory '%s'? ", path)
-		if !getYesNo() {
+	// With --one-file-system every directory is compared against the device
+	// of the command line argument
+	rootDev, _ := deviceID(info)
+
+	prompted := shouldPromptForFile(path, info, config)
+	if prompted {
+		if !ask(config, fmt.Sprintf("rm: descend into directory '%s'? ", path)) {
 			return nil
 		}
 	}
 
 	if config.useRecycleBin && !config.permanentDelete {
+		if config.oneFileSystem && containsOtherDevice(path, rootDev) {
+			return moveSameDeviceToRecycleBin(path, rootDev, config)
+		}
+
 		if config.verbose {
-			fmt.Printf("moved to recycle bin '%s'\n", path)
+			out.text("moved to recycle bin '%s'\n", path)
 		}
-		return moveToRecycleBin(path)
+		return recyclePath(path, info, prompted, config)
 	}
 
-	err = filepath.Walk(path, func(walkPath string, walkInfo os.FileInfo, walkErr error) error {
-		if walkErr != nil {
-			if !config.force {
-				return walkErr
-			}
-			return nil
-		}
+	remover := &treeRemover{config: config, rootDev: rootDev}
+	if err := remover.removeContents(path, info); err != nil && !config.force {
+		return err
+	}
 
-		if walkPath == path {
-			return nil
-		}
+	// The argument itself was already confirmed by the descend prompt
+	if err := remover.unlinkAt(unix.AT_FDCWD, removal{path: path, name: path, info: info}); err != nil {
+		return nil
+	}
+	if config.dryRun {
+		return nil
+	}
+	if config.verbose {
+		out.text("removed directory '%s'\n", path)
+	}
+	out.record(outputRecord{Type: "removed", Action: "deleted", Path: path})
 
-		if walkInfo.IsDir() {
+	return nil
+}
 
-			return nil
-		}
+// ask shows prompt and reads a yes/no answer. During a dry run nothing is
+// read and the answer is taken to be yes, so the preview covers everything
+// that could be removed.
+func ask(config Config, prompt string) bool {
+	if config.dryRun {
+		return true
+	}
+	out.message("%s", prompt)
+	return getYesNo()
+}
 
-		if shouldPromptForFile(walkPath, walkInfo, config) {
-			fmt.Printf("rm: remove %s '%s'? ", getFileType(walkInfo), walkPath)
-			if !getYesNo() {
-				return nil
-			}
+// recyclePath moves path into the recycle bin, or describes doing so during a dry run
+func recyclePath(path string, info os.FileInfo, prompted bool, config Config) error {
+	if config.dryRun {
+		size := dryRunSize(path, info)
+		if ok, err := previewQuota(path, info, size, prompted); !ok {
+			return err
 		}
-
-		if config.verbose {
-			fmt.Printf("removed '%s'\n", walkPath)
+		reportDryRun(path, info, "move to recycle bin", size, prompted)
+		if info.IsDir() {
+			reportDryRunTree(path)
 		}
+		return nil
+	}
 
-		return os.Remove(walkPath)
-	})
+	entry, err := moveToRecycleBin(path, config.transactionID, nil)
+	if err != nil {
+		return err
+	}
+	// An oversized item may have been deleted permanently instead, and
+	// reported as such
+	if entry.ID != "" {
+		out.record(outputRecord{Type: "removed", Action: "recycled", Path: path, ID: entry.ID, Entry: newEntryRecord(entry)})
+	}
+	return nil
+}
 
-	if err != nil && !config.force {
+// unlinkPath permanently removes path, or describes doing so during a dry run
+func unlinkPath(path string, info os.FileInfo, prompted bool, config Config) error {
+	if config.dryRun {
+		reportDryRun(path, info, "remove permanently", dryRunSize(path, info), prompted)
+		return nil
+	}
+	if err := os.Remove(path); err != nil {
 		return err
 	}
+	out.record(outputRecord{Type: "removed", Action: "deleted", Path: path})
+	return nil
+}
 
-	var dirs []string
-	filepath.Walk(path, func(walkPath string, walkInfo os.FileInfo, walkErr error) error {
-		if walkErr != nil {
+// reportDryRunTree reports each path below dir, which goes into the recycle
+// bin along with it without a prompt of its own
+func reportDryRunTree(dir string) {
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dir {
 			return nil
 		}
-		if walkInfo.IsDir() {
-			dirs = append(dirs, walkPath)
+		info, err := d.Info()
+		if err != nil {
+			return nil
 		}
+		reportDryRun(path, info, "move to recycle bin", dryRunSize(path, info), false)
 		return nil
 	})
+}
 
-	for i := len(dirs) - 1; i >= 0; i-- {
-		dir := dirs[i]
-		dirInfo, err := os.Lstat(dir)
-		if err != nil {
-			continue
-		}
-
-		if shouldPromptForFile(dir, dirInfo, config) && dir != path {
-			fmt.Printf("rm: remove directory '%s'? ", dir)
-			if !getYesNo() {
-				continue
-			}
-		}
-
-		if config.verbose {
-			fmt.Printf("removed directory '%s'\n", dir)
-		}
-		os.Remove(dir)
+// dryRunSize is the size a dry run shows for path: for a directory, what it
+// holds rather than the directory itself
+func dryRunSize(path string, info os.FileInfo) int64 {
+	if info.IsDir() {
+		return getDirSize(path)
 	}
+	return info.Size()
+}
 
-	return nil
+func reportDryRun(path string, info os.FileInfo, action string, size int64, prompted bool) {
+	prompt := "no prompt"
+	if prompted {
+		prompt = "would prompt"
+	}
+	rec := outputRecord{Type: "removed", Action: "deleted", Path: path, DryRun: true,
+		FileType: fileTypeName(info.Mode()), Size: &size, Prompted: prompted}
+	if action == "move to recycle bin" {
+		rec.Action = "recycled"
+	}
+	out.emit(rec, "would %s: '%s' (%s, %s, %s)\n", action, path, getFileType(info), formatSize(size), prompt)
 }
 
 func shouldPromptForFile(path string, info os.FileInfo, config Config) bool {
@@ -600,9 +837,71 @@ func isOnDifferentDevice(path1, path2 string) bool {
 	return sys1.Dev != sys2.Dev
 }
 
-func checkSameFileSystem(path string, config Config) error {
+func isOtherDevice(info os.FileInfo, dev uint64) bool {
+	infoDev, ok := deviceID(info)
+	return ok && infoDev != dev
+}
 
-	return nil
+// containsOtherDevice reports whether any directory below path is on a device
+// other than dev, i.e. whether something is mounted inside the tree
+func containsOtherDevice(path string, dev uint64) bool {
+	found := false
+	filepath.Walk(path, func(walkPath string, walkInfo os.FileInfo, walkErr error) error {
+		if walkErr != nil || found {
+			return nil
+		}
+		if walkInfo.IsDir() && isOtherDevice(walkInfo, dev) {
+			found = true
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return found
+}
+
+// moveSameDeviceToRecycleBin moves the parts of the tree at path that live on
+// device dev into the recycle bin piece by piece, leaving mounted directories
+// (and the directories leading to them) in place
+func moveSameDeviceToRecycleBin(path string, dev uint64, config Config) error {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	for _, entry := range entries {
+		childPath := filepath.Join(path, entry.Name())
+		childInfo, err := os.Lstat(childPath)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		if childInfo.IsDir() {
+			if isOtherDevice(childInfo, dev) {
+				out.notice(outputRecord{Type: "skipped", Path: childPath, Message: "on a different device"},
+					"rm: skipping '%s', since it's on a different device\n", childPath)
+				continue
+			}
+			if containsOtherDevice(childPath, dev) {
+				if err := moveSameDeviceToRecycleBin(childPath, dev, config); err != nil && firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+		}
+
+		if config.verbose {
+			out.text("moved to recycle bin '%s'\n", childPath)
+		}
+		if err := recyclePath(childPath, childInfo, false, config); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
 }
 
 func showHelp() {
@@ -626,23 +925,67 @@ Remove (unlink) the FILE(s).
   -r, -R, --recursive   remove directories and their contents recursively
   -d, --dir             remove empty directories
   -v, --verbose         explain what is being done
+      --jobs=N          with --permanent, delete up to N files of a directory
+                          in parallel (default: number of CPUs)
       --help     display this help and exit
       --version  output version information and exit
 
 Recycle Bin Options:
       --permanent       permanently delete files (bypass recycle bin)
+      --dry-run         show what would be removed, and how, without
+                          changing anything
       --setup-recycle-bin  setup recycle bin configuration
-      --clear-recycle-bin  permanently delete all items from recycle bin
+      --clear-recycle-bin  permanently delete all items from recycle bin;
+                          with -f, without asking first
       --list-recycle-bin   list items in recycle bin
-      --restore=PATH    restore file from recycle bin to original location
+      --compact-recycle-bin  compress files still stored uncompressed
+      --verify-recycle-bin   check every entry against its checksum and report
+                          corrupt, missing or orphaned stored files
+      --repair-recycle-bin   rebuild entries for stored files without one, drop
+                          entries whose file is gone and remove leftovers;
+                          with --dry-run, only report what would be done
+      --restore=PATH    restore file from recycle bin to original location;
+                          a bare name matches any entry of that name, a
+                          relative path is taken from the current directory;
+                          PATH may also be inside a deleted directory, to
+                          restore just that part of it
+      --restore         with filters, restore every matching entry
+      --restore-id=ID   restore the recycle bin entry with the given ID
+      --undo[=TXID]     restore everything removed by the last rm invocation,
+                          or by the invocation with transaction ID TXID
+      --restore-to=DEST  with a restore or undo, restore into directory DEST
+                          instead of the original location; a single entry
+                          can also be given a new path
+      --on-conflict=POLICY  when the destination exists: ask (default for a
+                          single entry), overwrite (the existing file goes
+                          to the recycle bin), rename (restore as
+                          'NAME (restored DATE)') or skip
       --recycle-bin-days=N  set retention days for recycle bin (default: 7)
+      --output=FORMAT   print results as table (default), json (one document)
+                          or ndjson (one record per line)
+
+Selecting entries (with --list-recycle-bin, --restore and --clear-recycle-bin):
+      --path-prefix=DIR    deleted from DIR or below it
+      --name-glob=PATTERN  base name matches PATTERN, e.g. '*.log'
+      --deleted-after=WHEN, --deleted-before=WHEN
+                          deleted after or before WHEN: a date such as
+                          2024-09-09 or '2024-09-09 14:30', or an age such
+                          as 30m, 2h, 3d or 1w
+      --min-size=SIZE, --max-size=SIZE
+                          original size at least or at most SIZE, e.g. 20K
+      --type=TYPE       file, dir, symlink, fifo, socket, char-device or
+                          block-device
+      --txid=TXID       removed by the rm invocation with transaction ID TXID
+      --sort=KEY        with --list-recycle-bin, order by time, size or path
+      --reverse         reverse the listing order
 
 By default, rm does not remove directories.  Use the --recursive (-r or -R)
 option to remove each listed directory, too, along with all of its contents.
 
 By default, files are moved to a recycle bin with compression and automatically 
 deleted after 7 days. Use --permanent to bypass the recycle bin and delete immediately.
-Files are compressed using gzip to save space while preserving full recoverability.
+Files are compressed (gzip by default, or zstd) to save space while preserving full
+recoverability; formats that are already compressed are stored as they are.
 
 To remove a file whose name starts with a '-', for example '-foo',
 use one of these commands:
@@ -653,8 +996,19 @@ use one of these commands:
 Examples:
   rm file.txt                    # Move file.txt to recycle bin
   rm --permanent file.txt        # Permanently delete file.txt
+  rm -r --dry-run build/         # Preview what removing build/ would do
   rm --list-recycle-bin          # List all items in recycle bin
   rm --restore=file.txt          # Restore file.txt from recycle bin
+  rm --restore-id=3f9a1c2e       # Restore the entry listed with that ID
+  rm --restore=proj/src/main.go  # Restore one file of the deleted proj/
+  rm --restore=file.txt --restore-to=/tmp
+                                 # Restore a copy of file.txt into /tmp
+  rm --list-recycle-bin --deleted-after=2h --sort=size --reverse
+                                 # Biggest items deleted in the last 2 hours
+  rm --restore --path-prefix=src --name-glob='*.go'
+                                 # Restore every .go file deleted from src/
+  rm --undo                      # Put back everything the last rm removed
+  rm --undo --on-conflict=rename # ... keeping anything created since
   rm --clear-recycle-bin         # Empty the recycle bin permanently
   rm --setup-recycle-bin         # Configure recycle bin settings
 
@@ -705,10 +1059,14 @@ func loadRecycleBinConfig() (*RecycleBinConfig, error) {
 	if _, err := os.Stat(configPath); os.IsNotExist(err) {
 
 		return &RecycleBinConfig{
-			Version:        version,
-			RecycleBinPath: getDefaultRecycleBinPath(),
-			RetentionDays:  7,
-			MaxSizeMB:      1024,
+			Version:         version,
+			RecycleBinPath:  getDefaultRecycleBinPath(),
+			RetentionDays:   7,
+			MaxSizeMB:       1024,
+			Backend:         backendBetterRM,
+			OversizePolicy:  oversizeRefuse,
+			Codec:           codecGzip,
+			SkipHighEntropy: true,
 		}, nil
 	}
 
@@ -784,11 +1142,33 @@ func setupRecycleBin() {
 		}
 	}
 
+	fmt.Printf("Use the desktop Trash (%s) instead? (y/n) [n]: ", getHomeTrashPath())
+	backend := backendBetterRM
+	if scanner.Scan() {
+		input := strings.TrimSpace(strings.ToLower(scanner.Text()))
+		if input == "y" || input == "yes" {
+			backend = backendFreeDesktop
+		}
+	}
+
+	fmt.Print("Compression codec (gzip, zstd, none) [gzip]: ")
+	codecName := codecGzip
+	if scanner.Scan() {
+		input := strings.TrimSpace(strings.ToLower(scanner.Text()))
+		if _, ok := codecs[input]; ok {
+			codecName = input
+		}
+	}
+
 	config := &RecycleBinConfig{
-		Version:        version,
-		RecycleBinPath: recycleBinPath,
-		RetentionDays:  retentionDays,
-		MaxSizeMB:      1024,
+		Version:         version,
+		RecycleBinPath:  recycleBinPath,
+		RetentionDays:   retentionDays,
+		MaxSizeMB:       1024,
+		Backend:         backend,
+		OversizePolicy:  oversizeRefuse,
+		Codec:           codecName,
+		SkipHighEntropy: true,
 	}
 
 	if err := os.MkdirAll(recycleBinPath, 0700); err != nil {
@@ -807,6 +1187,14 @@ func setupRecycleBin() {
 		os.Exit(1)
 	}
 
+	if backend == backendFreeDesktop {
+		if err := initFreeDesktopTrash(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Failed to create trash directory: %v\n", err)
+			os.Exit(1)
+		}
+		recycleBinPath = getHomeTrashPath()
+	}
+
 	fmt.Printf("Recycle bin setup complete!\n")
 	fmt.Printf("Location: %s\n", recycleBinPath)
 	fmt.Printf("Retention: %d days\n", retentionDays)
@@ -820,8 +1208,8 @@ func initRecycleBin() error {
 
 	configPath := getRecycleBinConfigPath()
 	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		fmt.Println("better-rm: First time setup detected.")
-		fmt.Println("Run 'better-rm --setup-recycle-bin' to configure the recycle bin.")
+		out.message("better-rm: First time setup detected.\n")
+		out.message("Run 'better-rm --setup-recycle-bin' to configure the recycle bin.\n")
 
 		if err := os.MkdirAll(config.RecycleBinPath, 0700); err != nil {
 			return err
@@ -839,141 +1227,100 @@ func initRecycleBin() error {
 		return err
 	}
 
+	if usesFreeDesktopTrash(config) {
+		return initFreeDesktopTrash()
+	}
+
 	metadataDir := filepath.Join(config.RecycleBinPath, ".metadata")
 	return os.MkdirAll(metadataDir, 0700)
 }
 
-func moveToRecycleBin(originalPath string) error {
+// moveToRecycleBin moves originalPath into the bin as part of transaction
+// transactionID, evicting old entries to make room except those in keep
+func moveToRecycleBin(originalPath, transactionID string, keep map[string]bool) (RecycleBinEntry, error) {
 	config, err := loadRecycleBinConfig()
 	if err != nil {
-		return err
+		return RecycleBinEntry{}, err
 	}
 
-	// Check if recycle bin is getting too large
-	currentSize := getDirSize(config.RecycleBinPath)
-	maxSize := config.MaxSizeMB * 1024 * 1024
-	if currentSize > maxSize {
-		fmt.Fprintf(os.Stderr, "Warning: Recycle bin is full (%s), cleaning up old files...\n", formatSize(currentSize))
-		cleanupRecycleBin()
-	}
+	store := openStore(config)
 
 	absPath, err := filepath.Abs(originalPath)
 	if err != nil {
-		return err
+		return RecycleBinEntry{}, err
 	}
 
 	fileInfo, err := os.Lstat(originalPath)
 	if err != nil {
-		return err
-	}
-
-	// Generate unique filename for storage using timestamp and hash
-	timestamp := time.Now().Format("20060102_150405")
-	hasher := md5.New()
-	hasher.Write([]byte(absPath))
-	hash := hex.EncodeToString(hasher.Sum(nil))[:8]
-
-	baseName := filepath.Base(originalPath)
-	isDirectory := fileInfo.IsDir()
-
-	var storedName string
-	var useCompression bool
-
-	if isDirectory {
-		// Directories aren't compressed, just renamed
-		storedName = fmt.Sprintf("%s_%s_%s", timestamp, hash, baseName)
-		useCompression = false
-	} else {
-		// Files get compressed to save space
-		storedName = fmt.Sprintf("%s_%s_%s.gz", timestamp, hash, baseName)
-		useCompression = true
+		return RecycleBinEntry{}, err
 	}
 
 	entry := RecycleBinEntry{
-		OriginalPath: absPath,
-		DeletedAt:    time.Now(),
-		StoredName:   storedName,
-		IsCompressed: useCompression,
-		OriginalSize: fileInfo.Size(),
-		IsDirectory:  isDirectory,
+		OriginalPath:  absPath,
+		DeletedAt:     time.Now(),
+		OriginalSize:  fileInfo.Size(),
+		IsDirectory:   fileInfo.IsDir(),
+		TransactionID: transactionID,
+		Attrs:         captureAttrs(originalPath, fileInfo),
+		FileType:      fileTypeName(fileInfo.Mode()),
 	}
 
-	destPath := filepath.Join(config.RecycleBinPath, storedName)
-
-	var compressedSize int64
-	if err := os.Rename(originalPath, destPath); err != nil {
-
-		if isDirectory {
-			if err := copyDir(originalPath, destPath); err != nil {
-				return err
-			}
-			compressedSize = getDirSize(destPath)
-		} else {
-			if err := copyAndCompressFile(originalPath, destPath); err != nil {
-				return err
-			}
-			if stat, err := os.Stat(destPath); err == nil {
-				compressedSize = stat.Size()
-			}
-		}
+	if entry.IsDirectory {
+		entry.OriginalSize = getDirSize(originalPath)
+	}
 
-		if err := os.RemoveAll(originalPath); err != nil {
+	switch {
+	case entry.FileType == fileTypeRegular:
+		entry.Codec, entry.CodecLevel = chooseCodec(config, originalPath)
+	case entry.IsDirectory && config.ArchiveDirectories:
+		entry.Codec, entry.CodecLevel = configuredCodec(config)
+	}
 
-			os.RemoveAll(destPath)
-			return err
-		}
-	} else {
-
-		if !isDirectory && useCompression {
-			tempPath := destPath + ".tmp"
-			if err := compressFileInPlace(destPath, tempPath); err != nil {
-
-				entry.IsCompressed = false
-				entry.StoredName = fmt.Sprintf("%s_%s_%s", timestamp, hash, baseName)
-				newDestPath := filepath.Join(config.RecycleBinPath, entry.StoredName)
-				os.Rename(destPath, newDestPath)
-				destPath = newDestPath
-			} else {
-				os.Rename(tempPath, destPath)
-				if stat, err := os.Stat(destPath); err == nil {
-					compressedSize = stat.Size()
-				}
-			}
+	if isSpecialEntry(entry) {
+		if err := describeSpecial(originalPath, fileInfo, &entry); err != nil {
+			return RecycleBinEntry{}, err
 		}
 	}
 
-	if useCompression && compressedSize > 0 {
-		entry.CompressedSize = compressedSize
+	// Sizes are checked before compression, so the quota is never
+	// overshot. An item too large for the bin is settled before locking
+	// it, since the oversize policy may wait on a prompt.
+	limit := quotaBytes(config)
+	if limit > 0 && entry.OriginalSize > limit {
+		return RecycleBinEntry{}, handleOversize(originalPath, entry.OriginalSize, limit, config)
 	}
 
-	metadataPath := filepath.Join(config.RecycleBinPath, ".metadata", storedName+".json")
-	tempMetadataPath := metadataPath + ".tmp"
-
-	entryData, err := json.MarshalIndent(entry, "", "  ")
+	// Checking the quota and moving the file in is one step, or two rm
+	// processes could both fit in the same free space
+	unlock, err := lockStore(store, true)
 	if err != nil {
-
-		os.RemoveAll(destPath)
-		return err
+		return RecycleBinEntry{}, fmt.Errorf("cannot lock recycle bin: %v", err)
 	}
+	defer unlock()
 
-	if err := os.WriteFile(tempMetadataPath, entryData, 0600); err != nil {
-
-		os.RemoveAll(destPath)
-		return err
+	// What has to make room is picked now, but only evicted once the move
+	// went through, so a failed one leaves the bin as it was
+	var usage *binUsage
+	var evictions []int
+	if limit > 0 {
+		if usage, err = measureUsage(store); err != nil {
+			return RecycleBinEntry{}, err
+		}
+		evictions = usage.evict(entry.OriginalSize, limit, keep)
 	}
 
-	if err := os.Rename(tempMetadataPath, metadataPath); err != nil {
-
-		os.Remove(tempMetadataPath)
-		os.RemoveAll(destPath)
-		return err
+	if err := store.Put(originalPath, &entry); err != nil {
+		return entry, err
 	}
-
-	return nil
+	if err := makeRoom(store, usage, evictions, limit); err != nil {
+		// The item is in the bin all the same, just over the limit
+		out.fail(errorFor(err, originalPath), "rm: %v\n", err)
+	}
+	return entry, nil
 }
 
 func copyFile(src, dst string) error {
-	srcInfo, err := os.Stat(src)
+	srcInfo, err := os.Lstat(src)
 	if err != nil {
 		return err
 	}
@@ -982,13 +1329,19 @@ func copyFile(src, dst string) error {
 		return copyDir(src, dst)
 	}
 
+	// Symlinks, FIFOs and device nodes are recreated, never opened
+	if !srcInfo.Mode().IsRegular() {
+		return copySpecial(src, dst, srcInfo)
+	}
+
 	srcFile, err := os.Open(src)
 	if err != nil {
 		return err
 	}
 	defer srcFile.Close()
 
-	dstFile, err := os.Create(dst)
+	// Never truncate a file that appeared at dst
+	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
 	if err != nil {
 		return err
 	}
@@ -999,7 +1352,11 @@ func copyFile(src, dst string) error {
 		return err
 	}
 
-	return os.Chmod(dst, srcInfo.Mode())
+	if err := dstFile.Close(); err != nil {
+		return err
+	}
+
+	return applyAttrs(dst, captureAttrs(src, srcInfo))
 }
 
 func copyDir(src, dst string) error {
@@ -1008,7 +1365,7 @@ func copyDir(src, dst string) error {
 		return err
 	}
 
-	if err := os.MkdirAll(dst, srcInfo.Mode()); err != nil {
+	if err := os.Mkdir(dst, srcInfo.Mode()); err != nil {
 		return err
 	}
 
@@ -1032,10 +1389,11 @@ func copyDir(src, dst string) error {
 		}
 	}
 
-	return nil
+	// Applied after the contents so writing them doesn't bump the mtime again
+	return applyAttrs(dst, captureAttrs(src, srcInfo))
 }
 
-func copyAndCompressFile(src, dst string) error {
+func copyAndCompressFile(src, dst string, c codec, level int) error {
 	srcFile, err := os.Open(src)
 	if err != nil {
 		return err
@@ -1048,20 +1406,19 @@ func copyAndCompressFile(src, dst string) error {
 	}
 	defer dstFile.Close()
 
-	// Use fastest compression for better performance
-	gzipWriter, err := gzip.NewWriterLevel(dstFile, gzip.BestSpeed)
+	writer, err := c.newWriter(dstFile, level)
 	if err != nil {
 		return err
 	}
-	defer gzipWriter.Close()
+	defer writer.Close()
 
-	written, err := io.Copy(gzipWriter, srcFile)
+	written, err := io.Copy(writer, srcFile)
 	if err != nil {
 		return fmt.Errorf("compression failed after %d bytes: %w", written, err)
 	}
 
-	if err := gzipWriter.Close(); err != nil {
-		return fmt.Errorf("failed to close gzip writer: %w", err)
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to close %s writer: %w", c.name, err)
 	}
 
 	srcInfo, err := os.Stat(src)
@@ -1072,7 +1429,7 @@ func copyAndCompressFile(src, dst string) error {
 	return os.Chmod(dst, srcInfo.Mode())
 }
 
-func compressFileInPlace(src, dst string) error {
+func compressFileInPlace(src, dst string, c codec, level int) error {
 	srcFile, err := os.Open(src)
 	if err != nil {
 		return err
@@ -1085,19 +1442,24 @@ func compressFileInPlace(src, dst string) error {
 	}
 	defer dstFile.Close()
 
-	gzipWriter, err := gzip.NewWriterLevel(dstFile, gzip.BestSpeed)
+	writer, err := c.newWriter(dstFile, level)
 	if err != nil {
 		return err
 	}
-	defer gzipWriter.Close()
+	defer writer.Close()
 
-	written, err := io.Copy(gzipWriter, srcFile)
+	written, err := io.Copy(writer, srcFile)
 	if err != nil {
 		return fmt.Errorf("compression failed after %d bytes: %w", written, err)
 	}
 
-	if err := gzipWriter.Close(); err != nil {
-		return fmt.Errorf("failed to close gzip writer: %w", err)
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to close %s writer: %w", c.name, err)
+	}
+
+	// The compressed copy replaces the only other one, so it must be on disk first
+	if err := dstFile.Sync(); err != nil {
+		return err
 	}
 
 	srcInfo, err := os.Stat(src)
@@ -1127,80 +1489,84 @@ func getDirSize(path string) int64 {
 	return size
 }
 
-func decompressFile(src, dst string) error {
+func decompressFile(src, dst string, c codec) error {
 	srcFile, err := os.Open(src)
 	if err != nil {
 		return err
 	}
 	defer srcFile.Close()
 
-	gzipReader, err := gzip.NewReader(srcFile)
+	reader, err := c.newReader(srcFile)
 	if err != nil {
 		return err
 	}
-	defer gzipReader.Close()
+	defer reader.Close()
 
-	dstFile, err := os.Create(dst)
+	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
 	if err != nil {
 		return err
 	}
 	defer dstFile.Close()
 
-	written, err := io.Copy(dstFile, gzipReader)
+	written, err := io.Copy(dstFile, reader)
 	if err != nil {
+		// The file is this call's own, so a partial one goes
+		os.Remove(dst)
 		return fmt.Errorf("decompression failed after %d bytes: %w", written, err)
 	}
 
-	return os.Chmod(dst, 0644)
+	return dstFile.Close()
 }
 
-func listRecycleBin() {
+func listRecycleBin(q entryQuery) {
 	config, err := loadRecycleBinConfig()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: Failed to load config: %v\n", err)
+		failf(codeConfig, "Failed to load config: %v", err)
 		return
 	}
 
-	metadataDir := filepath.Join(config.RecycleBinPath, ".metadata")
-	entries, err := os.ReadDir(metadataDir)
+	store := openStore(config)
+	unlock, err := lockStore(store, false)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: Failed to read recycle bin: %v\n", err)
+		failf(errorCode(err), "Failed to lock recycle bin: %v", err)
 		return
 	}
+	defer unlock()
 
-	if len(entries) == 0 {
-		fmt.Println("Recycle bin is empty")
+	all, err := store.List()
+	if err != nil {
+		failf(errorCode(err), "Failed to read recycle bin: %v", err)
 		return
 	}
 
-	fmt.Printf("%-20s %-15s %-12s %-8s %s\n", "Deleted At", "Size", "Compressed", "Savings", "Original Path")
-	fmt.Println(strings.Repeat("-", 85))
+	entries := q.apply(all)
+	counts := map[string]int{"total": len(all), "matched": len(entries)}
 
-	for _, entry := range entries {
-		if !strings.HasSuffix(entry.Name(), ".json") {
-			continue
-		}
+	if len(all) == 0 {
+		out.summarize(counts, "Recycle bin is empty\n")
+		return
+	}
 
-		metadataPath := filepath.Join(metadataDir, entry.Name())
-		data, err := os.ReadFile(metadataPath)
-		if err != nil {
-			continue
-		}
+	if len(entries) == 0 {
+		out.summarize(counts, "No entries match (%d in recycle bin)\n", len(all))
+		return
+	}
 
-		var binEntry RecycleBinEntry
-		if err := json.Unmarshal(data, &binEntry); err != nil {
-			continue
-		}
+	out.text("%-8s %-8s %-20s %-15s %-11s %-12s %-8s %s\n", "ID", "Txn", "Deleted At", "Size", "Codec", "Compressed", "Savings", "Original Path")
+	out.text("%s\n", strings.Repeat("-", 115))
 
-		storedPath := filepath.Join(config.RecycleBinPath, binEntry.StoredName)
-		var currentSize int64
-		if info, err := os.Stat(storedPath); err == nil {
-			currentSize = info.Size()
-		}
+	sizes := make(map[string]int64)
+	for _, binEntry := range entries {
+		_, currentSize, _ := store.Stat(binEntry.ID)
+		sizes[binEntry.ID] = currentSize
 
 		var sizeStr, compressedStr, savingsStr string
 
-		if binEntry.IsCompressed && binEntry.OriginalSize > 0 {
+		if binEntry.PendingCompression {
+			sizeStr = formatSize(currentSize)
+			compressedStr = "Pending"
+			savingsStr = "-"
+		} else if binEntry.IsCompressed && binEntry.OriginalSize > 0 {
 			sizeStr = formatSize(binEntry.OriginalSize)
 			compressedStr = formatSize(currentSize)
 			if currentSize < binEntry.OriginalSize {
@@ -1215,13 +1581,34 @@ func listRecycleBin() {
 			savingsStr = "-"
 		}
 
-		fmt.Printf("%-20s %-15s %-12s %-8s %s\n",
+		txID := binEntry.TransactionID
+		if txID == "" {
+			txID = "-"
+		}
+
+		rec := newEntryRecord(binEntry)
+		rec.StoredSize = currentSize
+		out.emit(outputRecord{Type: "entry", ID: binEntry.ID, Entry: rec},
+			"%-8s %-8s %-20s %-15s %-11s %-12s %-8s %s\n",
+			binEntry.ID,
+			txID,
 			binEntry.DeletedAt.Format("2006-01-02 15:04:05"),
 			sizeStr,
+			codecLabel(binEntry),
 			compressedStr,
 			savingsStr,
 			binEntry.OriginalPath)
 	}
+
+	if saved, shared := dedupSavings(entries, sizes); shared > 0 {
+		out.text("\nDeduplication: %d shared blobs save %s\n", shared, formatSize(saved))
+	}
+
+	if q.filtered() {
+		out.summarize(counts, "\n%d of %d entries match\n", len(entries), len(all))
+	} else {
+		out.summarize(counts, "")
+	}
 }
 
 func formatSize(size int64) string {
@@ -1237,152 +1624,236 @@ func formatSize(size int64) string {
 	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
 }
 
-func clearRecycleBin() {
+// clearRecycleBin permanently deletes the entries q selects, asking first
+// unless force is set
+func clearRecycleBin(q entryQuery, force bool) {
 	config, err := loadRecycleBinConfig()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: Failed to load config: %v\n", err)
+		failf(codeConfig, "Failed to load config: %v", err)
 		return
 	}
 
-	fmt.Print("Are you sure you want to permanently delete all items from the recycle bin? (y/n): ")
-	scanner := bufio.NewScanner(os.Stdin)
-	if !scanner.Scan() {
-		return
+	store := openStore(config)
+	if q.filtered() {
+		matches, err := queryEntries(store, q)
+		if err != nil {
+			failf(errorCode(err), "Failed to read recycle bin: %v", err)
+			return
+		}
+		if len(matches) == 0 {
+			out.summarize(map[string]int{"cleared": 0}, "No entries match\n")
+			return
+		}
+		if !force {
+			out.message("Are you sure you want to permanently delete %d matching items from the recycle bin? (y/n): ", len(matches))
+		}
+	} else if !force {
+		out.message("Are you sure you want to permanently delete all items from the recycle bin? (y/n): ")
 	}
 
-	response := strings.TrimSpace(strings.ToLower(scanner.Text()))
-	if response != "y" && response != "yes" {
-		fmt.Println("Operation cancelled")
+	if !force {
+		scanner := bufio.NewScanner(os.Stdin)
+		if !scanner.Scan() {
+			return
+		}
+
+		response := strings.TrimSpace(strings.ToLower(scanner.Text()))
+		if response != "y" && response != "yes" {
+			out.text("Operation cancelled\n")
+			out.fail(outputError{Code: codeCancelled, Message: "Operation cancelled"}, "")
+			return
+		}
+	}
+
+	unlock, err := lockStore(store, true)
+	if err != nil {
+		failf(errorCode(err), "Failed to lock recycle bin: %v", err)
 		return
 	}
+	defer unlock()
 
-	entries, err := os.ReadDir(config.RecycleBinPath)
+	// Matched again under the lock, in case the bin changed while we asked
+	entries, err := queryEntries(store, q)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: Failed to read recycle bin: %v\n", err)
+		failf(errorCode(err), "Failed to read recycle bin: %v", err)
 		return
 	}
 
 	count := 0
 	for _, entry := range entries {
-		if entry.Name() == ".metadata" {
-			continue
-		}
-
-		path := filepath.Join(config.RecycleBinPath, entry.Name())
-		if err := os.RemoveAll(path); err != nil {
-			fmt.Fprintf(os.Stderr, "Error removing %s: %v\n", path, err)
+		if err := store.Delete(entry.ID); err != nil {
+			e := errorFor(err, entry.OriginalPath)
+			e.ID = entry.ID
+			out.fail(e, "Error removing %s: %v\n", entry.OriginalPath, err)
 		} else {
+			out.record(outputRecord{Type: "cleared", ID: entry.ID, Path: entry.OriginalPath, Entry: newEntryRecord(entry)})
 			count++
 		}
 	}
 
-	metadataDir := filepath.Join(config.RecycleBinPath, ".metadata")
-	if err := os.RemoveAll(metadataDir); err != nil {
-		fmt.Fprintf(os.Stderr, "Error clearing metadata: %v\n", err)
+	// Blobs only go once nothing refers to them any more
+	if sweeper, ok := store.(blobSweeper); ok {
+		sweeper.SweepBlobs()
 	}
 
-	os.MkdirAll(metadataDir, 0700)
-
-	fmt.Printf("Cleared %d items from recycle bin\n", count)
+	out.summarize(map[string]int{"cleared": count}, "Cleared %d items from recycle bin\n", count)
 }
 
-func restoreFromRecycleBin(originalPath string) {
+func restoreFromRecycleBin(originalPath string, q entryQuery, opts restoreOptions) {
 	config, err := loadRecycleBinConfig()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: Failed to load config: %v\n", err)
+		failf(codeConfig, "Failed to load config: %v", err)
 		return
 	}
 
-	metadataDir := filepath.Join(config.RecycleBinPath, ".metadata")
-	entries, err := os.ReadDir(metadataDir)
+	// A bare name matches by base name; a path is taken relative to the
+	// current directory, as it was when deleted
+	name := originalPath
+	if strings.ContainsRune(originalPath, filepath.Separator) {
+		if name, err = filepath.Abs(originalPath); err != nil {
+			failf(errorCode(err), "Invalid path '%s': %v", originalPath, err)
+			return
+		}
+	}
+
+	// Search for the file in recycle bin metadata
+	store := openStore(config)
+	matches, err := findEntries(store, name)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: Failed to read recycle bin: %v\n", err)
+		failf(errorCode(err), "Failed to read recycle bin: %v", err)
 		return
 	}
+	matches = q.apply(matches)
 
-	var foundEntry *RecycleBinEntry
-	var metadataFile string
-
-	// Search for the file in recycle bin metadata
-	for _, entry := range entries {
-		if !strings.HasSuffix(entry.Name(), ".json") {
-			continue
+	// Not deleted itself, but perhaps along with a directory
+	var part string
+	if len(matches) == 0 {
+		if part, err = filepath.Abs(originalPath); err == nil {
+			matches, err = findContaining(store, part)
 		}
-
-		metadataPath := filepath.Join(metadataDir, entry.Name())
-		data, err := os.ReadFile(metadataPath)
 		if err != nil {
-			continue
-		}
-
-		var binEntry RecycleBinEntry
-		if err := json.Unmarshal(data, &binEntry); err != nil {
-			continue
-		}
-
-		if binEntry.OriginalPath == originalPath || filepath.Base(binEntry.OriginalPath) == originalPath {
-			foundEntry = &binEntry
-			metadataFile = metadataPath
-			break
+			failf(errorCode(err), "Failed to read recycle bin: %v", err)
+			return
 		}
+		matches = q.apply(matches)
 	}
 
-	if foundEntry == nil {
-		fmt.Fprintf(os.Stderr, "Error: File '%s' not found in recycle bin\n", originalPath)
+	if len(matches) == 0 {
+		failf(codeNotFound, "File '%s' not found in recycle bin", originalPath)
 		return
 	}
 
-	if _, err := os.Stat(foundEntry.OriginalPath); err == nil {
-		fmt.Printf("Warning: '%s' already exists. Overwrite? (y/n): ", foundEntry.OriginalPath)
-		scanner := bufio.NewScanner(os.Stdin)
-		if !scanner.Scan() {
-			return
+	if len(matches) > 1 {
+		failf(codeAmbiguous, "'%s' matches %d entries in recycle bin:", originalPath, len(matches))
+		for _, entry := range matches {
+			out.hint("  %-8s  %s  %s\n",
+				entry.ID, entry.DeletedAt.Format("2006-01-02 15:04:05"), entry.OriginalPath)
+			out.record(outputRecord{Type: "candidate", ID: entry.ID, Path: entry.OriginalPath, Entry: newEntryRecord(entry)})
 		}
-		response := strings.TrimSpace(strings.ToLower(scanner.Text()))
-		if response != "y" && response != "yes" {
-			fmt.Println("Restore cancelled")
+		if part != "" {
+			// --restore-id would bring back the whole directory
+			out.hint("Use a filter such as --deleted-after or --txid to pick one\n")
 			return
 		}
+		out.hint("Use --restore-id=ID, or a filter such as --deleted-after, to pick one\n")
+		return
 	}
 
-	cleanPath := filepath.Clean(foundEntry.OriginalPath)
-	if strings.Contains(cleanPath, "..") || !filepath.IsAbs(cleanPath) {
-		fmt.Fprintf(os.Stderr, "Error: Invalid restore path detected: %s\n", foundEntry.OriginalPath)
+	if part != "" {
+		restorePart(store, matches[0], part, opts)
 		return
 	}
+	restoreEntry(store, matches[0], opts)
+}
 
-	parentDir := filepath.Dir(cleanPath)
-	if err := os.MkdirAll(parentDir, 0755); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: Failed to create parent directory: %v\n", err)
+func restoreByID(id string, opts restoreOptions) {
+	config, err := loadRecycleBinConfig()
+	if err != nil {
+		failf(codeConfig, "Failed to load config: %v", err)
 		return
 	}
 
-	foundEntry.OriginalPath = cleanPath
+	store := openStore(config)
+	entry, _, err := store.Stat(id)
+	if err != nil && entry.ID == "" {
+		failf(codeNotFound, "No entry with ID '%s' in recycle bin", id)
+		return
+	}
 
-	storedPath := filepath.Join(config.RecycleBinPath, foundEntry.StoredName)
+	restoreEntry(store, entry, opts)
+}
 
-	if foundEntry.IsCompressed && !foundEntry.IsDirectory {
+// restoreEntry restores one entry, asking before it replaces anything
+// unless opts says otherwise
+func restoreEntry(store Store, entry RecycleBinEntry, opts restoreOptions) {
+	dst, err := opts.destination(entry, false)
+	if err != nil {
+		reportRestoreError(entry, err)
+		return
+	}
 
-		if err := decompressFile(storedPath, foundEntry.OriginalPath); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: Failed to decompress and restore file: %v\n", err)
-			return
-		}
-		os.Remove(storedPath)
-	} else {
+	if opts.onConflict == "" {
+		opts.onConflict = conflictAsk
+	}
+	restoreWithPolicy(store, entry, dst, opts)
+}
+
+// reportRestored reports entry restored to path, or only its part at part
+func reportRestored(entry RecycleBinEntry, path, part string) {
+	rec := outputRecord{Type: "restored", ID: entry.ID, Path: path, Entry: newEntryRecord(entry)}
+	if part != "" {
+		rec.Action = "partial"
+		out.emit(rec, "Restored '%s' from '%s'\n", path, entry.OriginalPath)
+		return
+	}
+	out.emit(rec, "Restored '%s'\n", path)
+}
 
-		if err := os.Rename(storedPath, foundEntry.OriginalPath); err != nil {
+func reportRestoreError(entry RecycleBinEntry, err error) {
+	e := errorFor(err, entry.OriginalPath)
+	e.ID = entry.ID
+	out.fail(e, "Error: %v\n", err)
+}
 
-			if err := copyFile(storedPath, foundEntry.OriginalPath); err != nil {
-				fmt.Fprintf(os.Stderr, "Error: Failed to restore file: %v\n", err)
-				return
-			}
-			os.RemoveAll(storedPath)
+// restoreToPath moves entry out of the bin to dst, usually where it was
+// deleted from, recreating missing parent directories. With part set, only
+// that path inside the directory entry is moved out.
+func restoreToPath(store Store, entry RecycleBinEntry, dst, part string) (string, error) {
+	cleanPath := filepath.Clean(dst)
+	if strings.Contains(cleanPath, "..") || !filepath.IsAbs(cleanPath) {
+		return "", withCode(codeInvalidArgument, fmt.Errorf("Invalid restore path detected: %s", dst))
+	}
+
+	unlock, err := lockStore(store, true)
+	if err != nil {
+		return "", fmt.Errorf("Failed to lock recycle bin: %w", err)
+	}
+	defer unlock()
+
+	// Check the payload first, so a damaged entry leaves nothing behind
+	if v, ok := store.(verifier); ok {
+		if err := v.Verify(entry.ID); err != nil {
+			return "", withCode(codeDamaged, fmt.Errorf("'%s' is damaged in the recycle bin: %v", entry.OriginalPath, err))
 		}
 	}
 
-	os.Remove(metadataFile)
+	parentDir := filepath.Dir(cleanPath)
+	if err := os.MkdirAll(parentDir, 0755); err != nil {
+		return "", fmt.Errorf("Failed to create parent directory: %w", err)
+	}
+
+	if part == "" {
+		err = store.Get(entry.ID, cleanPath)
+	} else if e, ok := store.(extractor); ok {
+		err = e.Extract(entry.ID, part, cleanPath)
+	} else {
+		err = withCode(codeUnsupported, fmt.Errorf("this recycle bin backend can only restore '%s' as a whole", entry.OriginalPath))
+	}
+	if err != nil {
+		return "", fmt.Errorf("Failed to restore file: %w", err)
+	}
 
-	fmt.Printf("Restored '%s'\n", foundEntry.OriginalPath)
+	return cleanPath, nil
 }
 
 func cleanupRecycleBin() {
@@ -1393,33 +1864,29 @@ func cleanupRecycleBin() {
 
 	cutoffTime := time.Now().AddDate(0, 0, -config.RetentionDays)
 
-	metadataDir := filepath.Join(config.RecycleBinPath, ".metadata")
-	entries, err := os.ReadDir(metadataDir)
+	store := openStore(config)
+	unlock, err := lockStore(store, true)
 	if err != nil {
 		return
 	}
+	defer unlock()
 
-	for _, entry := range entries {
-		if !strings.HasSuffix(entry.Name(), ".json") {
-			continue
-		}
+	entries, err := store.List()
+	if err != nil {
+		return
+	}
 
-		metadataPath := filepath.Join(metadataDir, entry.Name())
-		data, err := os.ReadFile(metadataPath)
-		if err != nil {
-			continue
+	// Entries come back oldest first, so stop at the first one still retained
+	for _, entry := range entries {
+		if !entry.DeletedAt.Before(cutoffTime) {
+			break
 		}
-
-		var binEntry RecycleBinEntry
-		if err := json.Unmarshal(data, &binEntry); err != nil {
-			continue
+		if store.Delete(entry.ID) == nil {
+			out.record(outputRecord{Type: "expired", ID: entry.ID, Path: entry.OriginalPath, Entry: newEntryRecord(entry)})
 		}
+	}
 
-		if binEntry.DeletedAt.Before(cutoffTime) {
-
-			storedPath := filepath.Join(config.RecycleBinPath, binEntry.StoredName)
-			os.RemoveAll(storedPath)
-			os.Remove(metadataPath)
-		}
+	if sweeper, ok := store.(blobSweeper); ok {
+		sweeper.SweepBlobs()
 	}
 }
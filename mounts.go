@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// deviceID returns the ID of the device holding the file described by info
+func deviceID(info os.FileInfo) (uint64, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(stat.Dev), true
+}
+
+// findMountRoot walks up from path until the parent directory lives on another
+// device, returning the top directory of the file system containing path
+func findMountRoot(path string) (string, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return "", err
+	}
+	dev, ok := deviceID(info)
+	if !ok {
+		return "/", nil
+	}
+
+	current := path
+	for {
+		parent := filepath.Dir(current)
+		if parent == current {
+			return current, nil
+		}
+
+		parentInfo, err := os.Stat(parent)
+		if err != nil {
+			return "", err
+		}
+		if parentDev, ok := deviceID(parentInfo); !ok || parentDev != dev {
+			return current, nil
+		}
+		current = parent
+	}
+}
+
+// listMountPoints returns every mount point listed in /proc/self/mountinfo
+func listMountPoints() ([]string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mounts []string
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+
+		mountPoint := unescapeMountPath(fields[4])
+		if !seen[mountPoint] {
+			seen[mountPoint] = true
+			mounts = append(mounts, mountPoint)
+		}
+	}
+
+	return mounts, scanner.Err()
+}
+
+// unescapeMountPath decodes the octal escapes (\040 for space etc.) the kernel
+// uses for whitespace and backslashes in mountinfo paths
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, "\\") {
+		return path
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
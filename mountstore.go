@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// volumeBinPrefix names the bin better-rm keeps at the top of every other
+// file system it deletes from: <mountroot>/.better-rm-bin-<uid>
+const volumeBinPrefix = ".better-rm-bin-"
+
+// mountStore spreads the better-rm layout over one bin per file system: the
+// configured bin for its own device and a volume bin at the root of every
+// other mount, so moving a file in is always a same-device rename. Reads
+// aggregate every bin that can be found from the mount table.
+type mountStore struct {
+	home  *dirStore
+	bins  map[string]*dirStore // root -> bin, home included; filled lazily
+	dedup bool
+}
+
+func newMountStore(root string, dedup bool) *mountStore {
+	home := &dirStore{root: root, dedup: dedup}
+	return &mountStore{home: home, bins: map[string]*dirStore{root: home}, dedup: dedup}
+}
+
+func (s *mountStore) Put(originalPath string, entry *RecycleBinEntry) error {
+	return s.binFor(entry.OriginalPath).Put(originalPath, entry)
+}
+
+func (s *mountStore) Get(id, dst string) error {
+	bin, err := s.find(id)
+	if err != nil {
+		return err
+	}
+	return bin.Get(id, dst)
+}
+
+func (s *mountStore) List() ([]RecycleBinEntry, error) {
+	var entries []RecycleBinEntry
+	for _, bin := range s.discover() {
+		binEntries, err := bin.List()
+		if err != nil {
+			if bin == s.home {
+				return nil, err
+			}
+			continue
+		}
+		entries = append(entries, binEntries...)
+	}
+
+	sortEntriesByTime(entries)
+	return entries, nil
+}
+
+func (s *mountStore) FindPath(name string) ([]RecycleBinEntry, error) {
+	var matches []RecycleBinEntry
+	for _, bin := range s.discover() {
+		binMatches, err := bin.FindPath(name)
+		if err != nil {
+			if bin == s.home {
+				return nil, err
+			}
+			continue
+		}
+		matches = append(matches, binMatches...)
+	}
+
+	sortEntriesByTime(matches)
+	return matches, nil
+}
+
+func (s *mountStore) Delete(id string) error {
+	bin, err := s.find(id)
+	if err != nil {
+		return err
+	}
+	return bin.Delete(id)
+}
+
+func (s *mountStore) Stat(id string) (RecycleBinEntry, int64, error) {
+	bin, err := s.find(id)
+	if err != nil {
+		return RecycleBinEntry{}, 0, err
+	}
+	return bin.Stat(id)
+}
+
+// find returns the bin holding entry id
+func (s *mountStore) find(id string) (*dirStore, error) {
+	for _, bin := range s.discover() {
+		if bin.load() != nil {
+			continue
+		}
+		if _, ok := bin.index.get(id); ok {
+			return bin, nil
+		}
+	}
+	return nil, fmt.Errorf("no entry with ID '%s' in recycle bin", id)
+}
+
+// binFor picks the bin absPath can be renamed into: the home bin when it
+// shares a device, else the volume bin of absPath's file system. When no
+// volume bin can be used the home bin takes the file with a copy.
+func (s *mountStore) binFor(absPath string) *dirStore {
+	parent := filepath.Dir(absPath)
+	if !isOnDifferentDevice(parent, s.home.root) {
+		return s.home
+	}
+
+	topDir, err := findMountRoot(parent)
+	if err != nil {
+		return s.home
+	}
+
+	root, err := volumeBinDir(topDir)
+	if err != nil {
+		return s.home
+	}
+	return s.bin(root)
+}
+
+func (s *mountStore) bin(root string) *dirStore {
+	if bin, ok := s.bins[root]; ok {
+		return bin
+	}
+	bin := &dirStore{root: root, dedup: s.dedup}
+	s.bins[root] = bin
+	return bin
+}
+
+// discover returns the home bin followed by every volume bin on a currently
+// mounted file system
+func (s *mountStore) discover() []*dirStore {
+	bins := []*dirStore{s.home}
+
+	mounts, err := listMountPoints()
+	if err != nil {
+		return bins
+	}
+
+	for _, mount := range mounts {
+		root := filepath.Join(mount, volumeBinPrefix+fmt.Sprint(os.Getuid()))
+		if root == s.home.root || !isOwnBinDir(root) {
+			continue
+		}
+		if info, err := os.Lstat(filepath.Join(root, ".metadata")); err != nil || !info.IsDir() {
+			continue
+		}
+		bins = append(bins, s.bin(root))
+	}
+
+	return bins
+}
+
+// volumeBinDir returns the bin on the file system mounted at topDir, creating
+// it if needed
+func volumeBinDir(topDir string) (string, error) {
+	root := filepath.Join(topDir, volumeBinPrefix+fmt.Sprint(os.Getuid()))
+	if err := os.Mkdir(root, 0700); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+
+	// Mount roots like /tmp are shared, so the bin could have been planted
+	// by someone else to capture our files
+	if !isOwnBinDir(root) {
+		return "", fmt.Errorf("'%s' is not a private directory owned by you", root)
+	}
+
+	if err := os.Mkdir(filepath.Join(root, ".metadata"), 0700); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	return root, nil
+}
+
+// isOwnBinDir reports whether dir is a real directory owned by the current
+// user that nobody else can write to
+func isOwnBinDir(dir string) bool {
+	info, err := os.Lstat(dir)
+	if err != nil || !info.IsDir() {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && int(stat.Uid) == os.Getuid() && info.Mode().Perm()&0022 == 0
+}
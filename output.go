@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"syscall"
+	"time"
+)
+
+// outputSchemaVersion is raised whenever a field of the JSON output is
+// removed or changes meaning; new fields and record types can be added
+// without raising it
+const outputSchemaVersion = 1
+
+// Output formats, selected with --output
+const (
+	outputTable  = "table" // default: the text rm has always printed
+	outputJSON   = "json"  // one document once the command is done
+	outputNDJSON = "ndjson"
+)
+
+// Error codes of outputError, documented in the README
+const (
+	codeNotFound        = "not_found"
+	codePermission      = "permission_denied"
+	codeExists          = "already_exists"
+	codeIsDirectory     = "is_directory"
+	codeNotEmpty        = "not_empty"
+	codeRootProtected   = "root_protected"
+	codeInvalidArgument = "invalid_argument"
+	codeAmbiguous       = "ambiguous"
+	codeConflict        = "conflict"
+	codeTooLarge        = "too_large"
+	codeDamaged         = "damaged"
+	codeCancelled       = "cancelled"
+	codeConfig          = "config"
+	codeUnsupported     = "unsupported"
+	codeFailed          = "failed" // anything else
+)
+
+// outputError is an error as reported in JSON output
+type outputError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Path    string `json:"path,omitempty"`
+	ID      string `json:"id,omitempty"`
+}
+
+// outputRecord is one thing a command did or found. Type says which, and
+// decides the fields that are set; see the README for each of them.
+type outputRecord struct {
+	Type    string       `json:"type"`
+	Action  string       `json:"action,omitempty"`
+	Status  string       `json:"status,omitempty"`
+	Path    string       `json:"path,omitempty"`
+	ID      string       `json:"id,omitempty"`
+	DryRun  bool         `json:"dry_run,omitempty"`
+	Message string       `json:"message,omitempty"`
+	Entry   *entryRecord `json:"entry,omitempty"`
+	Error   *outputError `json:"error,omitempty"`
+
+	// What a dry run shows of each path: its type, its size (a pointer, as 0
+	// is a size) and whether rm would prompt for it
+	FileType string `json:"file_type,omitempty"`
+	Size     *int64 `json:"size,omitempty"`
+	Prompted bool   `json:"prompted,omitempty"`
+}
+
+// entryRecord is a recycle bin entry as reported in JSON output. It is kept
+// apart from RecycleBinEntry so the index format can change without
+// breaking the output schema.
+type entryRecord struct {
+	ID                 string    `json:"id"`
+	TransactionID      string    `json:"txid,omitempty"`
+	OriginalPath       string    `json:"original_path"`
+	DeletedAt          time.Time `json:"deleted_at"`
+	FileType           string    `json:"file_type"`
+	Size               int64     `json:"size"`
+	StoredSize         int64     `json:"stored_size,omitempty"`
+	Codec              string    `json:"codec"`
+	CodecLevel         int       `json:"codec_level,omitempty"`
+	Archived           bool      `json:"archived,omitempty"`
+	PendingCompression bool      `json:"pending_compression,omitempty"`
+	PendingChecksum    bool      `json:"pending_checksum,omitempty"`
+	SHA256             string    `json:"sha256,omitempty"`
+}
+
+func newEntryRecord(entry RecycleBinEntry) *entryRecord {
+	rec := &entryRecord{
+		ID:                 entry.ID,
+		TransactionID:      entry.TransactionID,
+		OriginalPath:       entry.OriginalPath,
+		DeletedAt:          entry.DeletedAt,
+		FileType:           entryFileType(entry),
+		Size:               entry.OriginalSize,
+		Codec:              entryCodec(entry).name,
+		Archived:           entry.IsArchive,
+		PendingCompression: entry.PendingCompression,
+		PendingChecksum:    entry.PendingChecksum,
+		SHA256:             entry.SHA256,
+	}
+	if rec.Codec != codecNone {
+		rec.CodecLevel = entryCodecLevel(entry)
+	}
+	return rec
+}
+
+// jsonDocument is what --output=json prints
+type jsonDocument struct {
+	SchemaVersion int            `json:"schema_version"`
+	Command       string         `json:"command,omitempty"`
+	OK            bool           `json:"ok"`
+	Records       []outputRecord `json:"records"`
+	Errors        []outputError  `json:"errors"`
+	Summary       map[string]int `json:"summary,omitempty"`
+}
+
+// ndjsonLine is one line of --output=ndjson: a record, an error (type
+// "error") or, last, the summary (type "summary")
+type ndjsonLine struct {
+	SchemaVersion int    `json:"schema_version"`
+	Command       string `json:"command,omitempty"`
+	outputRecord
+	OK      *bool          `json:"ok,omitempty"`
+	Summary map[string]int `json:"summary,omitempty"`
+}
+
+// reporter writes what a command did: as text in table format, or as
+// records for the JSON formats. Text a JSON format has no record for, such
+// as headers, is left out, and prompts go to stderr so stdout stays
+// parseable.
+type reporter struct {
+	format  string
+	command string
+	records []outputRecord
+	errors  []outputError
+	summary map[string]int
+}
+
+var out = &reporter{format: outputTable}
+
+// structured reports whether a JSON format was asked for
+func (r *reporter) structured() bool {
+	return r.format != outputTable
+}
+
+// emit reports rec, or prints the text for it
+func (r *reporter) emit(rec outputRecord, format string, args ...any) {
+	if !r.structured() {
+		fmt.Printf(format, args...)
+		return
+	}
+	r.add(rec)
+}
+
+// notice is emit for text that goes to stderr, such as evictions
+func (r *reporter) notice(rec outputRecord, format string, args ...any) {
+	if !r.structured() {
+		fmt.Fprintf(os.Stderr, format, args...)
+		return
+	}
+	r.add(rec)
+}
+
+// record reports rec in the JSON formats only, for things table format
+// doesn't mention
+func (r *reporter) record(rec outputRecord) {
+	if r.structured() {
+		r.add(rec)
+	}
+}
+
+// fail reports e, or prints the text for it on stderr
+func (r *reporter) fail(e outputError, format string, args ...any) {
+	if !r.structured() {
+		fmt.Fprintf(os.Stderr, format, args...)
+		return
+	}
+	if r.format == outputNDJSON {
+		r.writeLine(ndjsonLine{outputRecord: outputRecord{Type: "error", Error: &e}})
+	}
+	r.errors = append(r.errors, e)
+}
+
+// text prints what only table format shows
+func (r *reporter) text(format string, args ...any) {
+	if !r.structured() {
+		fmt.Printf(format, args...)
+	}
+}
+
+// hint prints guidance around an error on stderr, in table format only
+func (r *reporter) hint(format string, args ...any) {
+	if !r.structured() {
+		fmt.Fprintf(os.Stderr, format, args...)
+	}
+}
+
+// message prints a prompt or notice meant for a person, on stderr when
+// stdout is being parsed
+func (r *reporter) message(format string, args ...any) {
+	if r.structured() {
+		fmt.Fprintf(os.Stderr, format, args...)
+		return
+	}
+	fmt.Printf(format, args...)
+}
+
+// summarize reports the totals of a command, or prints the text for them
+func (r *reporter) summarize(counts map[string]int, format string, args ...any) {
+	if !r.structured() {
+		fmt.Printf(format, args...)
+		return
+	}
+	r.summary = counts
+}
+
+func (r *reporter) add(rec outputRecord) {
+	if r.format == outputNDJSON {
+		r.writeLine(ndjsonLine{outputRecord: rec})
+		return
+	}
+	r.records = append(r.records, rec)
+}
+
+func (r *reporter) writeLine(line ndjsonLine) {
+	line.SchemaVersion = outputSchemaVersion
+	line.Command = r.command
+	data, _ := json.Marshal(line)
+	fmt.Printf("%s\n", data)
+}
+
+// finish prints the JSON document, or the closing summary line of NDJSON
+func (r *reporter) finish() {
+	ok := len(r.errors) == 0
+	switch r.format {
+	case outputJSON:
+		doc := jsonDocument{
+			SchemaVersion: outputSchemaVersion,
+			Command:       r.command,
+			OK:            ok,
+			Records:       r.records,
+			Errors:        r.errors,
+			Summary:       r.summary,
+		}
+		if doc.Records == nil {
+			doc.Records = []outputRecord{}
+		}
+		if doc.Errors == nil {
+			doc.Errors = []outputError{}
+		}
+		data, _ := json.MarshalIndent(doc, "", "  ")
+		fmt.Printf("%s\n", data)
+	case outputNDJSON:
+		r.writeLine(ndjsonLine{outputRecord: outputRecord{Type: "summary"}, OK: &ok, Summary: r.summary})
+	}
+}
+
+// exit finishes the output and exits with status code
+func (r *reporter) exit(code int) {
+	r.finish()
+	os.Exit(code)
+}
+
+// isOutputFormat reports whether format can be given to --output
+func isOutputFormat(format string) bool {
+	switch format {
+	case outputTable, outputJSON, outputNDJSON:
+		return true
+	}
+	return false
+}
+
+// usageError reports a bad command line and exits
+func usageError(hint bool, format string, args ...any) {
+	message := fmt.Sprintf(format, args...)
+	text := "rm: " + message + "\n"
+	if hint {
+		text += "Try 'rm --help' for more information.\n"
+	}
+	out.fail(outputError{Code: codeInvalidArgument, Message: message}, "%s", text)
+	out.exit(1)
+}
+
+// codedError carries the output error code of err
+type codedError struct {
+	code string
+	err  error
+}
+
+func (e *codedError) Error() string { return e.err.Error() }
+func (e *codedError) Unwrap() error { return e.err }
+
+// withCode gives err the output error code code
+func withCode(code string, err error) error {
+	return &codedError{code: code, err: err}
+}
+
+// errorCode returns the output error code for err
+func errorCode(err error) string {
+	var coded *codedError
+	switch {
+	case errors.As(err, &coded):
+		return coded.code
+	case errors.Is(err, fs.ErrNotExist):
+		return codeNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return codePermission
+	case errors.Is(err, fs.ErrExist):
+		return codeExists
+	case errors.Is(err, syscall.EISDIR):
+		return codeIsDirectory
+	case errors.Is(err, syscall.ENOTEMPTY):
+		return codeNotEmpty
+	}
+	return codeFailed
+}
+
+// errorFor builds the outputError for err, about path
+func errorFor(err error, path string) outputError {
+	return outputError{Code: errorCode(err), Message: err.Error(), Path: path}
+}
+
+// failf reports an error of a recycle bin command, printed as "Error: ..."
+func failf(code, format string, args ...any) {
+	message := fmt.Sprintf(format, args...)
+	out.fail(outputError{Code: code, Message: message}, "Error: %s\n", message)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// extractor is implemented by stores that can restore part of a directory
+// entry and keep the rest of it
+type extractor interface {
+	// Extract moves the file or subtree at rel inside directory entry id out
+	// to dst, and updates the entry to what is left in the bin
+	Extract(id, rel, dst string) error
+}
+
+// findContaining returns the directory entries that path was deleted with,
+// that is those whose original path is a parent of it
+func findContaining(store Store, path string) ([]RecycleBinEntry, error) {
+	entries, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []RecycleBinEntry
+	for _, entry := range entries {
+		if entry.IsDirectory && strings.HasPrefix(path, filepath.Clean(entry.OriginalPath)+string(filepath.Separator)) {
+			matches = append(matches, entry)
+		}
+	}
+	return matches, nil
+}
+
+// restorePart restores the file or directory at path, deleted along with
+// directory entry, leaving the rest of the entry in the bin
+func restorePart(store Store, entry RecycleBinEntry, path string, opts restoreOptions) {
+	rel, err := filepath.Rel(filepath.Clean(entry.OriginalPath), path)
+	if err != nil {
+		reportRestoreError(entry, err)
+		return
+	}
+	opts.part = rel
+
+	// The part goes where it was, or into --restore-to under its own name
+	inner := entry
+	inner.OriginalPath = path
+	dst, err := opts.destination(inner, false)
+	if err != nil {
+		reportRestoreError(entry, err)
+		return
+	}
+
+	if opts.onConflict == "" {
+		opts.onConflict = conflictAsk
+	}
+	restoreWithPolicy(store, entry, dst, opts)
+}
+
+// partPath returns where rel lives below the stored directory root. Every
+// directory on the way must be a real one, so a symlink stored in the
+// entry can't lead the restore to move something outside the bin.
+func partPath(root, rel string) (string, error) {
+	target, err := archiveTarget(root, rel)
+	if err != nil {
+		return "", err
+	}
+
+	dir := root
+	parts := strings.Split(strings.TrimPrefix(target, root+string(filepath.Separator)), string(filepath.Separator))
+	for _, name := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, name)
+		if info, err := os.Lstat(dir); err != nil || !info.IsDir() {
+			return "", fs.ErrNotExist
+		}
+	}
+
+	if _, err := os.Lstat(target); err != nil {
+		return "", fs.ErrNotExist
+	}
+	return target, nil
+}
+
+// movePart moves src out of the bin to dst, copying it across file systems.
+// Like Get, it never replaces something that appeared at dst.
+func movePart(src, dst string) error {
+	// A read-only directory in the entry would refuse to let go of it
+	parent := filepath.Dir(src)
+	if info, err := os.Lstat(parent); err == nil && info.Mode().Perm()&0200 == 0 {
+		if err := os.Chmod(parent, info.Mode()|0200); err == nil {
+			defer os.Chmod(parent, info.Mode())
+		}
+	}
+
+	if err := renameNoReplace(src, dst); err != nil {
+		if !errors.Is(err, unix.EXDEV) {
+			return err
+		}
+		// copyFile creates dst exclusively; unless that is what failed, what
+		// it left there is its own
+		if err := copyFile(src, dst); err != nil {
+			if !errors.Is(err, fs.ErrExist) {
+				os.RemoveAll(dst)
+			}
+			return err
+		}
+		return os.RemoveAll(src)
+	}
+	return nil
+}
+
+func (s *dirStore) Extract(id, rel, dst string) error {
+	unlock, err := s.Lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	entry, err := s.find(id)
+	if err != nil {
+		return err
+	}
+	if !entry.IsDirectory || isSpecialEntry(entry) {
+		return fmt.Errorf("'%s' is not a directory in the recycle bin", entry.OriginalPath)
+	}
+
+	if entry.IsArchive {
+		return s.extractFromArchive(entry, rel, dst)
+	}
+
+	src, err := partPath(s.storedPath(entry), rel)
+	if err != nil {
+		return fmt.Errorf("'%s' is not in the recycle bin: %w", filepath.Join(entry.OriginalPath, rel), err)
+	}
+	if err := movePart(src, dst); err != nil {
+		return err
+	}
+
+	entry.OriginalSize = getDirSize(s.storedPath(entry))
+	return s.index.put(entry)
+}
+
+// extractFromArchive unpacks the archive of entry into a work directory next
+// to it, moves the part out and archives the rest in place of the original.
+// The work directory is named like a compaction copy, so one left behind by
+// a crash is cleaned up by the next compaction or repair.
+func (s *dirStore) extractFromArchive(entry RecycleBinEntry, rel, dst string) error {
+	c := entryCodec(entry)
+	storedPath := s.storedPath(entry)
+	workDir := storedPath + ".tmp"
+	tree := filepath.Join(workDir, "tree")
+
+	os.RemoveAll(workDir)
+	if err := os.Mkdir(workDir, 0700); err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+
+	if err := extractArchive(storedPath, tree, c); err != nil {
+		return fmt.Errorf("failed to extract: %w", err)
+	}
+
+	src, err := partPath(tree, rel)
+	if err != nil {
+		return fmt.Errorf("'%s' is not in the recycle bin: %w", filepath.Join(entry.OriginalPath, rel), err)
+	}
+	if err := movePart(src, dst); err != nil {
+		return err
+	}
+
+	// The part is out, so from here on a failure only leaves a second copy
+	// of it in the bin
+	archive := filepath.Join(workDir, filepath.Base(storedPath))
+	err = archiveDir(tree, archive, c, entryCodecLevel(entry))
+	if err == nil {
+		err = os.Rename(archive, storedPath)
+	}
+	if err == nil {
+		err = syncDir(s.root)
+	}
+	if err != nil {
+		out.notice(outputRecord{Type: "leftover", ID: entry.ID, Path: filepath.Join(entry.OriginalPath, rel),
+			Message: fmt.Sprintf("restored, but still in the recycle bin entry: %v", err)},
+			"Warning: could not remove '%s' from the recycle bin copy of '%s': %v\n", rel, entry.OriginalPath, err)
+		return nil
+	}
+
+	entry.OriginalSize = getDirSize(tree)
+	if info, err := os.Stat(storedPath); err == nil {
+		entry.CompressedSize = info.Size()
+	}
+	return s.index.put(entry)
+}
+
+func (s *mountStore) Extract(id, rel, dst string) error {
+	bin, err := s.find(id)
+	if err != nil {
+		return err
+	}
+	return bin.Extract(id, rel, dst)
+}
+
+// Extract moves the part out of the trashed directory. The .trashinfo
+// records no size, so there is nothing else to update.
+func (s *trashStore) Extract(id, rel, dst string) error {
+	item, err := s.find(id)
+	if err != nil {
+		return err
+	}
+	if !item.entry.IsDirectory {
+		return fmt.Errorf("'%s' is not a directory in the trash", item.entry.OriginalPath)
+	}
+
+	src, err := partPath(item.storedPath, rel)
+	if err != nil {
+		return fmt.Errorf("'%s' is not in the trash: %w", filepath.Join(item.entry.OriginalPath, rel), err)
+	}
+	return movePart(src, dst)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// entryQuery selects and orders recycle bin entries for listing, restoring
+// and clearing
+type entryQuery struct {
+	pathPrefix string
+	nameGlob   string
+	after      time.Time
+	before     time.Time
+	minSize    int64
+	maxSize    int64 // -1 for no limit
+	fileType   string
+	txID       string
+
+	sortBy  string // "time", "size", "path" or empty for store order
+	reverse bool
+}
+
+// newEntryQuery returns a query selecting everything in store order
+func newEntryQuery() entryQuery {
+	return entryQuery{maxSize: -1}
+}
+
+// filtered reports whether any filter is set
+func (q entryQuery) filtered() bool {
+	return q.pathPrefix != "" || q.nameGlob != "" || !q.after.IsZero() || !q.before.IsZero() ||
+		q.minSize > 0 || q.maxSize >= 0 || q.fileType != "" || q.txID != ""
+}
+
+// used reports whether any filter or sort option was given
+func (q entryQuery) used() bool {
+	return q.filtered() || q.sortBy != "" || q.reverse
+}
+
+// isQueryOption reports whether arg is one of the filter or sort options
+func isQueryOption(arg string) bool {
+	name, _, _ := strings.Cut(arg, "=")
+	switch name {
+	case "--path-prefix", "--name-glob", "--deleted-after", "--deleted-before",
+		"--min-size", "--max-size", "--type", "--txid", "--sort", "--reverse":
+		return true
+	}
+	return false
+}
+
+// set applies the filter or sort option arg
+func (q *entryQuery) set(arg string) error {
+	if arg == "--reverse" {
+		q.reverse = true
+		return nil
+	}
+
+	name, value, ok := strings.Cut(arg, "=")
+	if !ok || value == "" {
+		return fmt.Errorf("option '%s' requires an argument", name)
+	}
+
+	var err error
+	switch name {
+	case "--path-prefix":
+		q.pathPrefix, err = filepath.Abs(value)
+	case "--name-glob":
+		if _, err := filepath.Match(value, ""); err != nil {
+			return fmt.Errorf("invalid pattern '%s' for '--name-glob'", value)
+		}
+		q.nameGlob = value
+	case "--deleted-after":
+		q.after, err = parseTimeBound(value)
+	case "--deleted-before":
+		q.before, err = parseTimeBound(value)
+	case "--min-size":
+		q.minSize, err = parseSize(value)
+	case "--max-size":
+		q.maxSize, err = parseSize(value)
+	case "--type":
+		q.fileType, err = parseFileType(value)
+	case "--txid":
+		q.txID = value
+	case "--sort":
+		switch value {
+		case "time", "size", "path":
+			q.sortBy = value
+		default:
+			return fmt.Errorf("invalid argument '%s' for '--sort' (use time, size or path)", value)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("invalid argument '%s' for '%s': %v", value, name, err)
+	}
+	return nil
+}
+
+// parseTimeBound reads an absolute date or time, or an age such as 30m, 2h,
+// 3d or 1w counted back from now
+func parseTimeBound(value string) (time.Time, error) {
+	units := map[byte]time.Duration{
+		's': time.Second,
+		'm': time.Minute,
+		'h': time.Hour,
+		'd': 24 * time.Hour,
+		'w': 7 * 24 * time.Hour,
+	}
+	if unit, ok := units[value[len(value)-1]]; ok {
+		if n, err := strconv.ParseFloat(value[:len(value)-1], 64); err == nil && n >= 0 {
+			return time.Now().Add(-time.Duration(n * float64(unit))), nil
+		}
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("expected a date like 2024-09-09 or 2024-09-09 14:30, or an age like 2h or 3d")
+}
+
+// parseSize reads a byte count with an optional K, M, G or T suffix (powers
+// of 1024, as formatSize prints them)
+func parseSize(value string) (int64, error) {
+	number := strings.TrimSuffix(strings.ToUpper(value), "B")
+	multiplier := int64(1)
+	if i := strings.IndexAny(number, "KMGT"); i >= 0 && i == len(number)-1 {
+		multiplier = int64(1) << (10 * (strings.IndexByte("KMGT", number[i]) + 1))
+		number = number[:i]
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("expected a size like 512, 20K or 1.5G")
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// parseFileType reads a --type value, accepting dir for directory
+func parseFileType(value string) (string, error) {
+	switch value {
+	case "dir":
+		return fileTypeDirectory, nil
+	case fileTypeRegular, fileTypeDirectory, fileTypeSymlink, fileTypeFIFO,
+		fileTypeSocket, fileTypeCharDevice, fileTypeBlockDevice:
+		return value, nil
+	}
+	return "", fmt.Errorf("expected file, dir, symlink, fifo, socket, char-device or block-device")
+}
+
+// entryFileType returns the type of entry, working it out for entries that
+// predate FileType
+func entryFileType(entry RecycleBinEntry) string {
+	switch {
+	case entry.FileType != "":
+		return entry.FileType
+	case entry.IsDirectory:
+		return fileTypeDirectory
+	default:
+		return fileTypeRegular
+	}
+}
+
+// matches reports whether entry passes every filter of q
+func (q entryQuery) matches(entry RecycleBinEntry) bool {
+	path := filepath.Clean(entry.OriginalPath)
+
+	// Whole path components only, so /src doesn't select /srv or /src2
+	if q.pathPrefix != "" && path != q.pathPrefix &&
+		!strings.HasPrefix(path, strings.TrimSuffix(q.pathPrefix, string(filepath.Separator))+string(filepath.Separator)) {
+		return false
+	}
+	if q.nameGlob != "" {
+		if ok, _ := filepath.Match(q.nameGlob, filepath.Base(path)); !ok {
+			return false
+		}
+	}
+	if !q.after.IsZero() && !entry.DeletedAt.After(q.after) {
+		return false
+	}
+	if !q.before.IsZero() && !entry.DeletedAt.Before(q.before) {
+		return false
+	}
+	if entry.OriginalSize < q.minSize || q.maxSize >= 0 && entry.OriginalSize > q.maxSize {
+		return false
+	}
+	if q.fileType != "" && entryFileType(entry) != q.fileType {
+		return false
+	}
+	if q.txID != "" && entry.TransactionID != q.txID {
+		return false
+	}
+	return true
+}
+
+// apply returns the entries q selects, in the order it asks for
+func (q entryQuery) apply(entries []RecycleBinEntry) []RecycleBinEntry {
+	var selected []RecycleBinEntry
+	for _, entry := range entries {
+		if q.matches(entry) {
+			selected = append(selected, entry)
+		}
+	}
+
+	var less func(a, b RecycleBinEntry) bool
+	switch q.sortBy {
+	case "time":
+		less = func(a, b RecycleBinEntry) bool { return a.DeletedAt.Before(b.DeletedAt) }
+	case "size":
+		less = func(a, b RecycleBinEntry) bool { return a.OriginalSize < b.OriginalSize }
+	case "path":
+		less = func(a, b RecycleBinEntry) bool { return a.OriginalPath < b.OriginalPath }
+	}
+
+	if less != nil {
+		sort.SliceStable(selected, func(i, j int) bool {
+			if q.reverse {
+				return less(selected[j], selected[i])
+			}
+			return less(selected[i], selected[j])
+		})
+	} else if q.reverse {
+		// Store order is oldest first
+		for i, j := 0, len(selected)-1; i < j; i, j = i+1, j-1 {
+			selected[i], selected[j] = selected[j], selected[i]
+		}
+	}
+	return selected
+}
+
+// queryEntries returns the entries of store that q selects
+func queryEntries(store Store, q entryQuery) ([]RecycleBinEntry, error) {
+	entries, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	return q.apply(entries), nil
+}
+
+// restoreMatching restores every entry q selects. Without an --on-conflict
+// policy it restores nothing if any of them can't go back where it came from.
+func restoreMatching(q entryQuery, opts restoreOptions) {
+	config, err := loadRecycleBinConfig()
+	if err != nil {
+		failf(codeConfig, "Failed to load config: %v", err)
+		return
+	}
+
+	store := openStore(config)
+	entries, err := queryEntries(store, q)
+	if err != nil {
+		failf(errorCode(err), "Failed to read recycle bin: %v", err)
+		return
+	}
+
+	if len(entries) == 0 {
+		failf(codeNotFound, "No entries in recycle bin match")
+		return
+	}
+
+	// Check every destination before touching anything, as undo does
+	conflicts, err := destinationConflicts(entries, opts)
+	if err != nil {
+		failf(errorCode(err), "Invalid restore destination: %v", err)
+		return
+	}
+	if len(conflicts) > 0 {
+		out.hint("Error: Cannot restore the %d matching entries:\n", len(entries))
+		for _, conflict := range conflicts {
+			out.fail(conflict, "  %s (%s)\n", conflict.Path, conflict.Message)
+		}
+		out.hint("Narrow the filters, move the paths out of the way, pick --on-conflict or restore entries individually with --restore-id\n")
+		return
+	}
+
+	restored := restoreEntries(store, entries, opts)
+	out.summarize(map[string]int{"restored": restored, "matched": len(entries)},
+		"Restored %d of %d matching items\n", restored, len(entries))
+}
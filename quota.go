@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// What to do with an item larger than the whole recycle bin, selected
+// through RecycleBinConfig.OversizePolicy
+const (
+	oversizeRefuse    = "refuse" // default
+	oversizePrompt    = "prompt"
+	oversizePermanent = "permanent"
+)
+
+// quotaBytes returns the recycle bin size limit, or 0 when it is unlimited
+func quotaBytes(config *RecycleBinConfig) int64 {
+	if config.MaxSizeMB <= 0 {
+		return 0
+	}
+	return config.MaxSizeMB * 1024 * 1024
+}
+
+// binUsage is what a recycle bin holds, as counted against its limit
+type binUsage struct {
+	entries  []RecycleBinEntry // least recently deleted first
+	sizes    []int64
+	evicted  []bool
+	blobRefs map[string]int
+	usage    int64
+}
+
+func measureUsage(store Store) (*binUsage, error) {
+	entries, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	// A shared blob takes space once, and is freed with its last entry
+	u := &binUsage{entries: entries, sizes: make([]int64, len(entries)), evicted: make([]bool, len(entries)), blobRefs: make(map[string]int)}
+	for i, entry := range entries {
+		if _, size, err := store.Stat(entry.ID); err == nil {
+			u.sizes[i] = size
+			if entry.Blob != "" {
+				u.blobRefs[entry.Blob]++
+				if u.blobRefs[entry.Blob] > 1 {
+					continue
+				}
+			}
+			u.usage += size
+		}
+	}
+	return u, nil
+}
+
+// evict takes entries out of u, least recently deleted first, until needed
+// more bytes fit under limit, and returns their positions in u.entries.
+// Entries in keep stay, even if that leaves the bin over its limit.
+func (u *binUsage) evict(needed, limit int64, keep map[string]bool) []int {
+	var evicted []int
+	for i, entry := range u.entries {
+		if u.usage+needed <= limit {
+			break
+		}
+		if u.evicted[i] || keep[entry.ID] {
+			continue
+		}
+
+		if entry.Blob == "" {
+			u.usage -= u.sizes[i]
+		} else if u.blobRefs[entry.Blob]--; u.blobRefs[entry.Blob] == 0 {
+			u.usage -= u.sizes[i]
+		}
+		u.evicted[i] = true
+		evicted = append(evicted, i)
+	}
+	return evicted
+}
+
+// makeRoom evicts the entries of u at positions evictions, as picked by
+// u.evict, reporting each eviction on stderr
+func makeRoom(store Store, u *binUsage, evictions []int, limit int64) error {
+	for _, i := range evictions {
+		entry := u.entries[i]
+		if err := store.Delete(entry.ID); err != nil {
+			return fmt.Errorf("cannot evict '%s' from recycle bin: %v", entry.OriginalPath, err)
+		}
+
+		out.notice(outputRecord{Type: "evicted", ID: entry.ID, Path: entry.OriginalPath, Entry: newEntryRecord(entry)},
+			"rm: recycle bin limit is %s, evicted %s '%s' (%s, deleted %s)\n",
+			formatSize(limit), entry.ID, entry.OriginalPath, formatSize(u.sizes[i]),
+			entry.DeletedAt.Format("2006-01-02 15:04:05"))
+	}
+
+	return nil
+}
+
+// dryRunUsage is the bin as the dry run so far would have left it, so each
+// item is checked against the room the ones before it took
+var dryRunUsage *binUsage
+
+// previewQuota reports what the quota would make of moving path, of size
+// bytes, into the recycle bin: which entries it would evict, or how an item
+// too large for the bin would be handled. It reports false when path would
+// not go into the bin at all.
+func previewQuota(path string, info os.FileInfo, size int64, prompted bool) (bool, error) {
+	config, err := loadRecycleBinConfig()
+	if err != nil {
+		return false, err
+	}
+	limit := quotaBytes(config)
+	if limit == 0 {
+		return true, nil
+	}
+
+	if size > limit {
+		return false, previewOversize(path, info, size, limit, prompted, config)
+	}
+
+	if dryRunUsage == nil {
+		// A bin not set up yet is empty, and a dry run doesn't create it
+		dryRunUsage, err = measureUsage(openStore(config))
+		if errors.Is(err, fs.ErrNotExist) {
+			dryRunUsage, err = &binUsage{blobRefs: make(map[string]int)}, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	for _, i := range dryRunUsage.evict(size, limit, nil) {
+		entry := dryRunUsage.entries[i]
+		out.emit(outputRecord{Type: "evicted", ID: entry.ID, Path: entry.OriginalPath, Entry: newEntryRecord(entry), DryRun: true},
+			"would evict %s '%s' (%s, deleted %s) to keep the recycle bin under its %s limit\n",
+			entry.ID, entry.OriginalPath, formatSize(dryRunUsage.sizes[i]),
+			entry.DeletedAt.Format("2006-01-02 15:04:05"), formatSize(limit))
+	}
+	dryRunUsage.usage += size
+	return true, nil
+}
+
+// previewOversize is handleOversize for a dry run
+func previewOversize(path string, info os.FileInfo, size, limit int64, prompted bool, config *RecycleBinConfig) error {
+	switch config.OversizePolicy {
+	case oversizePermanent:
+		reportDryRun(path, info, "remove permanently", size, prompted)
+		return nil
+
+	case oversizePrompt:
+		prompt := fmt.Sprintf("rm: '%s' (%s) is larger than the recycle bin limit (%s); delete it permanently?",
+			path, formatSize(size), formatSize(limit))
+		out.emit(outputRecord{Type: "prompt", DryRun: true, Message: prompt}, "would prompt: '%s'\n", prompt)
+		reportDryRun(path, info, "remove permanently", size, true)
+		return nil
+
+	default:
+		return handleOversize(path, size, limit, config)
+	}
+}
+
+// handleOversize deals with path, which is too large to ever fit in the
+// recycle bin, according to the configured policy
+func handleOversize(path string, size, limit int64, config *RecycleBinConfig) error {
+	switch config.OversizePolicy {
+	case oversizePermanent:
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+		out.notice(oversizeRecord(path),
+			"rm: '%s' (%s) is larger than the recycle bin limit (%s), deleted it permanently\n",
+			path, formatSize(size), formatSize(limit))
+		return nil
+
+	case oversizePrompt:
+		out.message("rm: '%s' (%s) is larger than the recycle bin limit (%s); delete it permanently? ",
+			path, formatSize(size), formatSize(limit))
+		if !getYesNo() {
+			return nil
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+		out.record(oversizeRecord(path))
+		return nil
+
+	default:
+		return withCode(codeTooLarge, fmt.Errorf("cannot move '%s' to recycle bin: %s is larger than its %s limit (use --permanent to delete it)",
+			path, formatSize(size), formatSize(limit)))
+	}
+}
+
+// oversizeRecord reports path as deleted permanently in place of recycling it
+func oversizeRecord(path string) outputRecord {
+	return outputRecord{Type: "removed", Action: "deleted", Path: path, Message: "larger than the recycle bin limit"}
+}
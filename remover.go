@@ -0,0 +1,321 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// treeRemover permanently deletes the contents of a directory tree. The
+// files of each directory are unlinked by a pool of at most config.jobs
+// workers; prompting, directory removal and verbose output stay on the
+// calling goroutine and follow sorted name order, so runs are reproducible.
+//
+// The tree is walked through directory file descriptors: every name is
+// examined with fstatat and removed with unlinkat relative to the directory
+// it was found in, and directories are entered with openat(O_NOFOLLOW), so
+// swapping a directory for a symlink mid-walk can't redirect the deletion
+// outside the tree.
+type treeRemover struct {
+	config  Config
+	rootDev uint64
+}
+
+// removal is one directory entry queued for deletion
+type removal struct {
+	path     string // shown in prompts and messages
+	name     string // relative to the directory descriptor
+	info     os.FileInfo
+	prompted bool
+}
+
+// removeContents deletes everything below the directory path, which was
+// examined as info, leaving path itself
+func (r *treeRemover) removeContents(path string, info os.FileInfo) error {
+	fd, err := openDirAt(unix.AT_FDCWD, path, path, info)
+	if err != nil {
+		if !r.config.force {
+			return err
+		}
+		return nil
+	}
+	defer unix.Close(fd)
+
+	return r.removeContentsAt(fd, path)
+}
+
+// removeContentsAt deletes everything in the directory open as dirfd, depth
+// first; dir is its path for display
+func (r *treeRemover) removeContentsAt(dirfd int, dir string) error {
+	config := r.config
+
+	names, err := readDirNames(dirfd, dir)
+	if err != nil {
+		if !config.force {
+			return err
+		}
+		return nil
+	}
+
+	var files, subdirs []removal
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+
+		var stat unix.Stat_t
+		if err := unix.Fstatat(dirfd, name, &stat, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			if err == unix.ENOENT {
+				continue
+			}
+			if !config.force {
+				return &os.PathError{Op: "stat", Path: path, Err: err}
+			}
+			continue
+		}
+		info := newStatInfo(name, &stat)
+
+		if info.IsDir() {
+			if config.oneFileSystem && isOtherDevice(info, r.rootDev) {
+				out.notice(outputRecord{Type: "skipped", Path: path, Message: "on a different device"},
+					"rm: skipping '%s', since it's on a different device\n", path)
+				continue
+			}
+			subdirs = append(subdirs, removal{path: path, name: name, info: info})
+			continue
+		}
+
+		prompted := shouldPromptForFile(path, info, config)
+		if prompted {
+			if !ask(config, fmt.Sprintf("rm: remove %s '%s'? ", getFileType(info), path)) {
+				continue
+			}
+		}
+		files = append(files, removal{path: path, name: name, info: info, prompted: prompted})
+	}
+
+	errs := r.unlinkAll(dirfd, files)
+	for i, file := range files {
+		if errs[i] != nil {
+			if !config.force {
+				return errs[i]
+			}
+			continue
+		}
+		// A dry run has reported it already
+		if !config.dryRun {
+			out.record(outputRecord{Type: "removed", Action: "deleted", Path: file.path})
+		}
+		if config.verbose {
+			out.text("removed '%s'\n", file.path)
+		}
+	}
+
+	for _, subdir := range subdirs {
+		fd, err := openDirAt(dirfd, subdir.name, subdir.path, subdir.info)
+		if err != nil {
+			if !config.force {
+				return err
+			}
+			continue
+		}
+		err = r.removeContentsAt(fd, subdir.path)
+		unix.Close(fd)
+		if err != nil {
+			return err
+		}
+
+		prompted := shouldPromptForFile(subdir.path, subdir.info, config)
+		if prompted {
+			if !ask(config, fmt.Sprintf("rm: remove directory '%s'? ", subdir.path)) {
+				continue
+			}
+		}
+		subdir.prompted = prompted
+
+		// Directories still holding skipped entries stay behind
+		if err := r.unlinkAt(dirfd, subdir); err != nil {
+			continue
+		}
+		if !config.dryRun {
+			out.record(outputRecord{Type: "removed", Action: "deleted", Path: subdir.path})
+		}
+		if config.verbose {
+			out.text("removed directory '%s'\n", subdir.path)
+		}
+	}
+
+	return nil
+}
+
+// unlinkAll removes files concurrently and returns each one's error by index
+func (r *treeRemover) unlinkAll(dirfd int, files []removal) []error {
+	errs := make([]error, len(files))
+
+	jobs := r.config.jobs
+	if jobs > len(files) {
+		jobs = len(files)
+	}
+
+	// Dry-run reports are printed as they are made, so keep them in order
+	if jobs <= 1 || r.config.dryRun {
+		for i, file := range files {
+			errs[i] = r.unlinkAt(dirfd, file)
+		}
+		return errs
+	}
+
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				errs[i] = r.unlinkAt(dirfd, files[i])
+			}
+		}()
+	}
+
+	for i := range files {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	return errs
+}
+
+// unlinkAt removes entry from the directory open as dirfd, or describes doing
+// so during a dry run. Directories are removed with AT_REMOVEDIR and
+// everything else without it, so an entry swapped for one of the other kind
+// since it was examined fails instead of being removed.
+func (r *treeRemover) unlinkAt(dirfd int, entry removal) error {
+	if r.config.dryRun {
+		reportDryRun(entry.path, entry.info, "remove permanently", dryRunSize(entry.path, entry.info), entry.prompted)
+		return nil
+	}
+
+	flags := 0
+	if entry.info.IsDir() {
+		flags = unix.AT_REMOVEDIR
+	}
+	if err := unix.Unlinkat(dirfd, entry.name, flags); err != nil {
+		return &os.PathError{Op: "remove", Path: entry.path, Err: err}
+	}
+	return nil
+}
+
+// openDirAt opens the directory name relative to dirfd without following a
+// symlink, and checks it is still the directory that was examined as info
+func openDirAt(dirfd int, name, path string, info os.FileInfo) (int, error) {
+	fd, err := unix.Openat(dirfd, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err == unix.ELOOP || err == unix.ENOTDIR {
+		// A symlink or file has taken the place of the directory
+		return -1, fmt.Errorf("'%s' was replaced while it was being removed", path)
+	}
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+
+	var stat unix.Stat_t
+	if err := unix.Fstat(fd, &stat); err != nil {
+		unix.Close(fd)
+		return -1, &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+
+	want, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || uint64(stat.Dev) != uint64(want.Dev) || uint64(stat.Ino) != uint64(want.Ino) {
+		unix.Close(fd)
+		return -1, fmt.Errorf("'%s' was replaced while it was being removed", path)
+	}
+
+	return fd, nil
+}
+
+// readDirNames lists the directory open as dirfd in sorted order, leaving
+// dirfd itself open
+func readDirNames(dirfd int, dir string) ([]string, error) {
+	fd, err := unix.Dup(dirfd)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: err}
+	}
+
+	f := os.NewFile(uintptr(fd), dir)
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// statInfo is an os.FileInfo built from an fstatat result, so entries found
+// through a directory descriptor go through the same prompting and dry-run
+// code as entries found by path
+type statInfo struct {
+	name string
+	stat syscall.Stat_t
+}
+
+func newStatInfo(name string, stat *unix.Stat_t) *statInfo {
+	return &statInfo{
+		name: name,
+		stat: syscall.Stat_t{
+			Dev:     stat.Dev,
+			Ino:     stat.Ino,
+			Nlink:   stat.Nlink,
+			Mode:    stat.Mode,
+			Uid:     stat.Uid,
+			Gid:     stat.Gid,
+			Rdev:    stat.Rdev,
+			Size:    stat.Size,
+			Blksize: stat.Blksize,
+			Blocks:  stat.Blocks,
+			Atim:    syscall.Timespec{Sec: stat.Atim.Sec, Nsec: stat.Atim.Nsec},
+			Mtim:    syscall.Timespec{Sec: stat.Mtim.Sec, Nsec: stat.Mtim.Nsec},
+			Ctim:    syscall.Timespec{Sec: stat.Ctim.Sec, Nsec: stat.Ctim.Nsec},
+		},
+	}
+}
+
+func (fi *statInfo) Name() string       { return fi.name }
+func (fi *statInfo) Size() int64        { return fi.stat.Size }
+func (fi *statInfo) ModTime() time.Time { return time.Unix(fi.stat.Mtim.Unix()) }
+func (fi *statInfo) IsDir() bool        { return fi.Mode().IsDir() }
+func (fi *statInfo) Sys() any           { return &fi.stat }
+
+// Mode converts st_mode the same way os.Lstat does
+func (fi *statInfo) Mode() os.FileMode {
+	mode := os.FileMode(fi.stat.Mode & 0777)
+	switch fi.stat.Mode & syscall.S_IFMT {
+	case syscall.S_IFBLK:
+		mode |= os.ModeDevice
+	case syscall.S_IFCHR:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case syscall.S_IFDIR:
+		mode |= os.ModeDir
+	case syscall.S_IFIFO:
+		mode |= os.ModeNamedPipe
+	case syscall.S_IFLNK:
+		mode |= os.ModeSymlink
+	case syscall.S_IFSOCK:
+		mode |= os.ModeSocket
+	}
+	if fi.stat.Mode&syscall.S_ISGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if fi.stat.Mode&syscall.S_ISUID != 0 {
+		mode |= os.ModeSetuid
+	}
+	if fi.stat.Mode&syscall.S_ISVTX != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
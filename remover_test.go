@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// raceTree creates root/a/inner and root/b, plus an outside directory that a
+// symlink swapped in for root/a will point to
+func raceTree(t *testing.T) (root, outside string) {
+	t.Helper()
+	base := t.TempDir()
+	root = filepath.Join(base, "root")
+	outside = filepath.Join(base, "outside")
+
+	for _, dir := range []string{filepath.Join(root, "a"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{filepath.Join(root, "a", "inner"), filepath.Join(root, "b"), filepath.Join(outside, "keep")} {
+		if err := os.WriteFile(file, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root, outside
+}
+
+// swapForSymlink replaces the directory dir with a symlink to target
+func swapForSymlink(dir, target string) error {
+	if err := os.Rename(dir, dir+".old"); err != nil {
+		return err
+	}
+	return os.Symlink(target, dir)
+}
+
+func removerFor(t *testing.T, root string, config Config) (*treeRemover, os.FileInfo) {
+	t.Helper()
+	info, err := os.Lstat(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.jobs == 0 {
+		config.jobs = 1
+	}
+	rootDev, _ := deviceID(info)
+	return &treeRemover{config: config, rootDev: rootDev}, info
+}
+
+// TestRemoveContentsSymlinkSwap swaps root/a for a symlink after the walk
+// has examined it but before it is entered. The walk stops at the prompt
+// for root/b, which comes between the two in name order.
+func TestRemoveContentsSymlinkSwap(t *testing.T) {
+	root, outside := raceTree(t)
+	r, info := removerFor(t, root, Config{interactiveFlag: true})
+
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStdin, oldStdout := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = stdinR, stdoutW
+	defer func() { os.Stdin, os.Stdout = oldStdin, oldStdout }()
+
+	swapped := make(chan error, 1)
+	go func() {
+		// Answer the prompt for root/b only once the swap is done
+		reader := bufio.NewReader(stdoutR)
+		for {
+			prompt, err := reader.ReadString('?')
+			if err != nil {
+				swapped <- err
+				return
+			}
+			if strings.Contains(prompt, filepath.Join(root, "b")) {
+				break
+			}
+			stdinW.WriteString("y\n")
+		}
+		swapped <- swapForSymlink(filepath.Join(root, "a"), outside)
+		stdinW.WriteString("y\n")
+	}()
+
+	fd, err := openDirAt(unix.AT_FDCWD, root, root, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.removeContentsAt(fd, root)
+	unix.Close(fd)
+	stdoutW.Close()
+
+	if swapErr := <-swapped; swapErr != nil {
+		t.Fatalf("swapping in the symlink: %v", swapErr)
+	}
+	if err == nil || !strings.Contains(err.Error(), "was replaced") {
+		t.Fatalf("removeContentsAt returned %v, want an error saying root/a was replaced", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "keep")); err != nil {
+		t.Fatalf("file outside the tree was removed: %v", err)
+	}
+}
+
+// TestOpenDirAtReplaced checks both ways a directory can be replaced after
+// it was examined: by a symlink, and by another directory
+func TestOpenDirAtReplaced(t *testing.T) {
+	root, outside := raceTree(t)
+	dir := filepath.Join(root, "a")
+
+	info, err := os.Lstat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := swapForSymlink(dir, outside); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openDirAt(unix.AT_FDCWD, dir, dir, info); err == nil || !strings.Contains(err.Error(), "was replaced") {
+		t.Fatalf("openDirAt on a symlink returned %v, want 'was replaced'", err)
+	}
+
+	if err := os.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openDirAt(unix.AT_FDCWD, dir, dir, info); err == nil || !strings.Contains(err.Error(), "was replaced") {
+		t.Fatalf("openDirAt on another directory returned %v, want 'was replaced'", err)
+	}
+}
+
+// TestRemoveContentsRacingSwaps removes trees while another goroutine keeps
+// swapping a subdirectory and a symlink to the outside directory
+func TestRemoveContentsRacingSwaps(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		root, outside := raceTree(t)
+		for n := 0; n < 20; n++ {
+			os.WriteFile(filepath.Join(root, "a", "f"+strings.Repeat("x", n)), []byte("x"), 0644)
+		}
+		r, info := removerFor(t, root, Config{force: true, jobs: 4})
+
+		var stop atomic.Bool
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			dir := filepath.Join(root, "a")
+			for !stop.Load() {
+				if swapForSymlink(dir, outside) == nil {
+					time.Sleep(time.Microsecond)
+					os.Remove(dir)
+					os.Rename(dir+".old", dir)
+				}
+			}
+		}()
+
+		r.removeContents(root, info)
+		stop.Store(true)
+		<-done
+
+		if _, err := os.Stat(filepath.Join(outside, "keep")); err != nil {
+			t.Fatalf("iteration %d: file outside the tree was removed: %v", i, err)
+		}
+	}
+}
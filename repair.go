@@ -0,0 +1,406 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// storedNamePattern matches the names dirStore.Put gives payloads:
+// <YYYYMMDD_HHMMSS>[-N]_<8-char hash of the original path>_<base name>
+var storedNamePattern = regexp.MustCompile(`^(\d{8}_\d{6})(?:-\d+)?_([0-9a-f]{8})_(.+)$`)
+
+// repairer is implemented by stores that can rebuild their metadata from
+// what is actually on disk
+type repairer interface {
+	// Repair brings entries and stored files back in line, or with dryRun
+	// only reports what it would do
+	Repair(dryRun bool) (repairReport, error)
+}
+
+type repairReport struct {
+	recovered []recovery        // stored files that had no entry
+	dropped   []RecycleBinEntry // entries whose stored file was gone
+	removed   []string          // leftover temporary files and unused blobs
+	skipped   []string          // stray files not named like a payload
+}
+
+// recovery is an entry rebuilt from a stored file's name. pathKnown is
+// false when the original location could not be worked out and the entry
+// restores to the home directory instead.
+type recovery struct {
+	entry     RecycleBinEntry
+	pathKnown bool
+}
+
+func (s *dirStore) Repair(dryRun bool) (repairReport, error) {
+	var report repairReport
+
+	// Holding the compaction lock keeps a pass from moving files underneath.
+	// A dry run changes nothing, so it only needs to read the bin.
+	if !dryRun {
+		lock, err := s.lockCompaction()
+		if err != nil {
+			return report, err
+		}
+		if lock == nil {
+			return report, fmt.Errorf("a compaction pass is running in '%s', try again once it is done", s.root)
+		}
+		defer lock.Close()
+	}
+
+	unlock, err := s.Lock(!dryRun)
+	if err != nil {
+		return report, err
+	}
+	defer unlock()
+
+	if err := s.load(); err != nil {
+		return report, err
+	}
+
+	// Entries about to be dropped still tell where files used to live
+	candidates := s.candidateDirs()
+
+	for _, entry := range s.index.entries() {
+		if isSpecialEntry(entry) {
+			continue
+		}
+		if _, err := os.Lstat(s.storedPath(entry)); !os.IsNotExist(err) {
+			continue
+		}
+		report.dropped = append(report.dropped, entry)
+		if !dryRun {
+			if err := s.index.remove(entry.ID); err != nil {
+				return report, err
+			}
+			s.releaseBlob(entry)
+		}
+	}
+
+	leftovers := s.compactionLeftovers()
+	if _, err := os.Lstat(s.index.path + ".tmp"); err == nil {
+		leftovers = append(leftovers, s.index.path+".tmp")
+	}
+	isLeftover := make(map[string]bool)
+	for _, path := range leftovers {
+		isLeftover[path] = true
+	}
+
+	orphans, err := s.Orphans()
+	if err != nil {
+		return report, err
+	}
+
+	for _, path := range orphans {
+		switch {
+		case isLeftover[path]:
+			// Removed below with the other leftovers
+		case filepath.Dir(filepath.Dir(path)) == filepath.Join(s.root, blobDirName):
+			leftovers = append(leftovers, path)
+		default:
+			recovered, ok := s.recoverEntry(filepath.Base(path), candidates)
+			if !ok {
+				report.skipped = append(report.skipped, path)
+				continue
+			}
+			report.recovered = append(report.recovered, recovered)
+			if !dryRun {
+				if err := s.index.put(recovered.entry); err != nil {
+					return report, err
+				}
+			}
+		}
+	}
+
+	for _, path := range leftovers {
+		report.removed = append(report.removed, path)
+		if !dryRun {
+			os.RemoveAll(path)
+		}
+	}
+
+	return report, nil
+}
+
+// recoverEntry rebuilds the entry of the stored file name from what its name
+// and contents tell. The original path is found by hashing candidate
+// locations from candidates, since the name only carries a hash of it.
+func (s *dirStore) recoverEntry(name string, candidates []string) (recovery, bool) {
+	match := storedNamePattern.FindStringSubmatch(name)
+	if match == nil {
+		return recovery{}, false
+	}
+	deletedAt, err := time.ParseInLocation("20060102_150405", match[1], time.Local)
+	if err != nil {
+		return recovery{}, false
+	}
+	pathHash, baseName := match[2], match[3]
+
+	path := filepath.Join(s.root, name)
+	info, err := os.Lstat(path)
+	if err != nil || !(info.Mode().IsRegular() || info.IsDir()) {
+		return recovery{}, false
+	}
+
+	entry := RecycleBinEntry{
+		ID:          entryID(name),
+		DeletedAt:   deletedAt,
+		StoredName:  name,
+		IsDirectory: info.IsDir(),
+		FileType:    fileTypeName(info.Mode()),
+		Codec:       codecNone,
+	}
+
+	// The same name could be a compressed copy of a file or directory, or a
+	// file that simply ended in .gz; the hash of the original path decides
+	// when it can be found, and otherwise the contents are kept as they are
+	type reading struct {
+		base    string
+		c       codec
+		archive bool
+	}
+	readings := []reading{{base: baseName, c: codecs[codecNone]}}
+	if ext, ok := codecExt(baseName); ok && info.Mode().IsRegular() {
+		c := codecByExt(ext)
+		base := strings.TrimSuffix(baseName, ext)
+		if tarBase, ok := strings.CutSuffix(base, archiveExt); ok {
+			readings = append([]reading{{base: tarBase, c: c, archive: true}}, readings...)
+		}
+		readings = append([]reading{{base: base, c: c}}, readings...)
+	}
+
+	chosen, pathKnown := readings[len(readings)-1], false
+	for _, r := range readings {
+		if r.c.name != codecNone && !isEncodedWith(path, r.c) {
+			continue
+		}
+		if originalPath, ok := findOriginalPath(candidates, r.base, pathHash); ok {
+			chosen, pathKnown = r, true
+			entry.OriginalPath = originalPath
+			break
+		}
+	}
+	if !pathKnown {
+		home, _ := os.UserHomeDir()
+		entry.OriginalPath = filepath.Join(home, chosen.base)
+	}
+
+	entry.OriginalSize = info.Size()
+	switch {
+	case chosen.archive:
+		entry.IsDirectory = true
+		entry.IsArchive = true
+		entry.FileType = fileTypeDirectory
+		entry.OriginalSize = archivedSize(path, chosen.c)
+	case entry.IsDirectory:
+		entry.OriginalSize = getDirSize(path)
+	case chosen.c.name != codecNone:
+		entry.OriginalSize = decodedSize(path, chosen.c)
+	}
+	if chosen.c.name != codecNone {
+		entry.IsCompressed = true
+		entry.Codec = chosen.c.name
+		entry.CompressedSize = info.Size()
+	}
+
+	return recovery{entry: entry, pathKnown: pathKnown}, true
+}
+
+// candidateDirs returns the directories files in the bin were likely deleted
+// from: those of every known entry and their parents, the working directory
+// and home
+func (s *dirStore) candidateDirs() []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	add := func(dir string) {
+		for dir != "" && !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+			parent := filepath.Dir(dir)
+			if parent == dir {
+				break
+			}
+			dir = parent
+		}
+	}
+
+	for _, entry := range s.index.entries() {
+		add(filepath.Dir(entry.OriginalPath))
+	}
+	if wd, err := os.Getwd(); err == nil {
+		add(wd)
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		add(home)
+	}
+	return dirs
+}
+
+// findOriginalPath returns the path in dirs named base whose hash, as used in
+// stored names, is pathHash
+func findOriginalPath(dirs []string, base, pathHash string) (string, bool) {
+	for _, dir := range dirs {
+		path := filepath.Join(dir, base)
+		sum := md5.Sum([]byte(path))
+		if hex.EncodeToString(sum[:])[:8] == pathHash {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// codecByExt returns the codec whose extension is ext
+func codecByExt(ext string) codec {
+	for _, c := range codecs {
+		if c.ext == ext {
+			return c
+		}
+	}
+	return codecs[codecNone]
+}
+
+// isEncodedWith reports whether the file at path starts like a stream of c
+func isEncodedWith(path string, c codec) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	reader, err := c.newReader(f)
+	if err != nil {
+		return false
+	}
+	defer reader.Close()
+
+	_, err = reader.Read(make([]byte, 1))
+	return err == nil || err == io.EOF
+}
+
+// decodedSize returns how many bytes the file at path decompresses to, as
+// far as it can be read
+func decodedSize(path string, c codec) int64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	reader, err := c.newReader(f)
+	if err != nil {
+		return 0
+	}
+	defer reader.Close()
+
+	size, _ := io.Copy(io.Discard, reader)
+	return size
+}
+
+// archivedSize returns the total size of the files in the archive at path
+func archivedSize(path string, c codec) int64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	reader, err := c.newReader(f)
+	if err != nil {
+		return 0
+	}
+	defer reader.Close()
+
+	var size int64
+	tr := tar.NewReader(reader)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			return size
+		}
+		size += header.Size
+	}
+}
+
+func (s *mountStore) Repair(dryRun bool) (repairReport, error) {
+	var report repairReport
+	for _, bin := range s.discover() {
+		binReport, err := bin.Repair(dryRun)
+		report.recovered = append(report.recovered, binReport.recovered...)
+		report.dropped = append(report.dropped, binReport.dropped...)
+		report.removed = append(report.removed, binReport.removed...)
+		report.skipped = append(report.skipped, binReport.skipped...)
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+func repairRecycleBin(dryRun bool) {
+	config, err := loadRecycleBinConfig()
+	if err != nil {
+		failf(codeConfig, "Failed to load config: %v", err)
+		return
+	}
+
+	r, ok := openStore(config).(repairer)
+	if !ok {
+		out.text("Nothing to repair: the desktop Trash keeps no index of its own\n")
+		return
+	}
+
+	report, err := r.Repair(dryRun)
+
+	// A dry run reports the same actions, as what it would do
+	verb := func(done, todo string) string {
+		if dryRun {
+			return "Would " + todo
+		}
+		return done
+	}
+
+	for _, rec := range report.recovered {
+		note := ""
+		if !rec.pathKnown {
+			note = " (original location unknown)"
+		}
+		out.emit(outputRecord{Type: "recovered", ID: rec.entry.ID, Path: rec.entry.OriginalPath, DryRun: dryRun,
+			Message: strings.TrimSpace(note), Entry: newEntryRecord(rec.entry)},
+			"%s '%s' as '%s'%s\n", verb("Recovered", "recover"), rec.entry.StoredName, rec.entry.OriginalPath, note)
+	}
+	for _, entry := range report.dropped {
+		out.emit(outputRecord{Type: "dropped", ID: entry.ID, Path: entry.OriginalPath, DryRun: dryRun, Entry: newEntryRecord(entry)},
+			"%s entry %s for '%s': its stored file is missing\n", verb("Dropped", "drop"), entry.ID, entry.OriginalPath)
+	}
+	for _, path := range report.removed {
+		out.emit(outputRecord{Type: "leftover", Action: "removed", Path: path, DryRun: dryRun},
+			"%s leftover '%s'\n", verb("Removed", "remove"), path)
+	}
+	for _, path := range report.skipped {
+		out.emit(outputRecord{Type: "skipped", Path: path, Message: "not named like a stored file"},
+			"Skipped '%s': not named like a stored file\n", path)
+	}
+
+	if err != nil {
+		failf(errorCode(err), "Failed to repair recycle bin: %v", err)
+		return
+	}
+
+	counts := map[string]int{"recovered": len(report.recovered), "dropped": len(report.dropped),
+		"removed": len(report.removed), "skipped": len(report.skipped)}
+	if dryRun {
+		out.summarize(counts, "Dry run: would recover %d, drop %d and remove %d leftovers; %d skipped\n",
+			len(report.recovered), len(report.dropped), len(report.removed), len(report.skipped))
+		return
+	}
+	out.summarize(counts, "Repaired recycle bin: %d recovered, %d dropped, %d leftovers removed, %d skipped\n",
+		len(report.recovered), len(report.dropped), len(report.removed), len(report.skipped))
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// What a restore does when something is already where the entry would go,
+// selected with --on-conflict
+const (
+	conflictAsk       = "ask"
+	conflictOverwrite = "overwrite" // the existing file goes to the bin first
+	conflictRename    = "rename"    // restore next to it under a new name
+	conflictSkip      = "skip"
+)
+
+// restoreOptions says where restores go and how they handle conflicts
+type restoreOptions struct {
+	to         string          // --restore-to, empty for each entry's original location
+	onConflict string          // empty for the command's default
+	txID       string          // transaction of the files overwrites send to the bin
+	part       string          // path inside a directory entry to restore on its own
+	batch      map[string]bool // IDs restored together, never evicted meanwhile
+}
+
+func isConflictPolicy(policy string) bool {
+	switch policy {
+	case conflictAsk, conflictOverwrite, conflictRename, conflictSkip:
+		return true
+	}
+	return false
+}
+
+// destination returns where entry is restored to. When to is a directory,
+// or asDir is set because several entries are restored at once, the entry
+// keeps its name inside it; otherwise to is the new path itself.
+func (o restoreOptions) destination(entry RecycleBinEntry, asDir bool) (string, error) {
+	if o.to == "" {
+		return entry.OriginalPath, nil
+	}
+
+	to, err := filepath.Abs(o.to)
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(to); err == nil && info.IsDir() || asDir || strings.HasSuffix(o.to, string(filepath.Separator)) {
+		return filepath.Join(to, filepath.Base(entry.OriginalPath)), nil
+	}
+	return to, nil
+}
+
+// restoreWithPolicy restores entry, or the part of it opts names, to dst,
+// dealing with anything already there as opts.onConflict says, and reports
+// the outcome. It returns whether the entry was restored.
+func restoreWithPolicy(store Store, entry RecycleBinEntry, dst string, opts restoreOptions) bool {
+	if _, err := os.Lstat(dst); err == nil {
+		switch opts.onConflict {
+		case conflictSkip:
+			out.emit(outputRecord{Type: "skipped", ID: entry.ID, Path: dst, Message: "already exists"},
+				"Skipped '%s': it already exists\n", dst)
+			return false
+
+		case conflictRename:
+			dst = restoredSibling(dst, time.Now())
+
+		case conflictAsk:
+			out.message("Warning: '%s' already exists. Overwrite? (y/n): ", dst)
+			if !getYesNo() {
+				out.text("Restore cancelled\n")
+				out.fail(outputError{Code: codeCancelled, Message: "Restore cancelled", Path: dst, ID: entry.ID}, "")
+				return false
+			}
+			return restoreOver(store, entry, dst, opts)
+
+		case conflictOverwrite:
+			return restoreOver(store, entry, dst, opts)
+		}
+	}
+
+	path, err := restoreToPath(store, entry, dst, opts.part)
+	if err != nil {
+		reportRestoreError(entry, err)
+		return false
+	}
+	reportRestored(entry, path, opts.part)
+	return true
+}
+
+// restoreOver restores entry in place of what is at dst, which goes to the
+// bin rather than being destroyed. The entry is restored next to dst first,
+// so making room in the bin for the replaced file can never evict it; if
+// the replaced file can't be moved away, the entry stays under that name.
+func restoreOver(store Store, entry RecycleBinEntry, dst string, opts restoreOptions) bool {
+	sibling := restoredSibling(dst, time.Now())
+	path, err := restoreToPath(store, entry, sibling, opts.part)
+	if err != nil {
+		reportRestoreError(entry, err)
+		return false
+	}
+
+	replaced, err := moveToRecycleBin(dst, opts.txID, opts.batch)
+	if _, statErr := os.Lstat(dst); err == nil && statErr == nil {
+		// Too large for the bin, and the oversize prompt said to keep it
+		err = fmt.Errorf("it is still there")
+	}
+	if err == nil {
+		// An oversized file is deleted permanently instead, and reported as such
+		if replaced.ID != "" {
+			out.emit(outputRecord{Type: "removed", Action: "recycled", Path: dst, ID: replaced.ID, Entry: newEntryRecord(replaced),
+				Message: "replaced by a restore"}, "Moved existing '%s' to the recycle bin\n", dst)
+		}
+		err = os.Rename(path, dst)
+	}
+	if err != nil {
+		reportRestoreError(entry, fmt.Errorf("could not replace '%s', restored as '%s' instead: %w", dst, path, err))
+		reportRestored(entry, path, opts.part)
+		return true
+	}
+
+	reportRestored(entry, dst, opts.part)
+	return true
+}
+
+// restoredSibling returns a free name next to path for a renamed restore,
+// like "notes (restored 2026-10-16).txt"
+func restoredSibling(path string, now time.Time) string {
+	dir, base := filepath.Split(path)
+	ext := filepath.Ext(base)
+	if ext == base {
+		// Dotfiles like .bashrc have no extension to keep
+		ext = ""
+	} else if strings.HasSuffix(strings.TrimSuffix(base, ext), ".tar") {
+		ext = ".tar" + ext
+	}
+	stem := strings.TrimSuffix(base, ext)
+	label := "restored " + now.Format("2006-01-02")
+
+	for n := 1; ; n++ {
+		name := fmt.Sprintf("%s (%s)%s", stem, label, ext)
+		if n > 1 {
+			name = fmt.Sprintf("%s (%s %d)%s", stem, label, n, ext)
+		}
+		candidate := filepath.Join(dir, name)
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// File types recorded in RecycleBinEntry.FileType
+const (
+	fileTypeRegular     = "file"
+	fileTypeDirectory   = "directory"
+	fileTypeSymlink     = "symlink"
+	fileTypeFIFO        = "fifo"
+	fileTypeSocket      = "socket"
+	fileTypeCharDevice  = "char-device"
+	fileTypeBlockDevice = "block-device"
+)
+
+func fileTypeName(mode os.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return fileTypeDirectory
+	case mode&os.ModeSymlink != 0:
+		return fileTypeSymlink
+	case mode&os.ModeNamedPipe != 0:
+		return fileTypeFIFO
+	case mode&os.ModeSocket != 0:
+		return fileTypeSocket
+	case mode&os.ModeCharDevice != 0:
+		return fileTypeCharDevice
+	case mode&os.ModeDevice != 0:
+		return fileTypeBlockDevice
+	default:
+		return fileTypeRegular
+	}
+}
+
+// isSpecialEntry reports whether entry has no contents to store: symlinks,
+// FIFOs, sockets and device nodes are kept as metadata only
+func isSpecialEntry(entry RecycleBinEntry) bool {
+	switch entry.FileType {
+	case fileTypeSymlink, fileTypeFIFO, fileTypeSocket, fileTypeCharDevice, fileTypeBlockDevice:
+		return true
+	}
+	return false
+}
+
+// describeSpecial records what is needed to recreate a special file: a
+// symlink's target, or a device node's major and minor numbers
+func describeSpecial(path string, info os.FileInfo, entry *RecycleBinEntry) error {
+	switch entry.FileType {
+	case fileTypeSymlink:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		entry.LinkTarget = target
+	case fileTypeCharDevice, fileTypeBlockDevice:
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("cannot read device numbers of '%s'", path)
+		}
+		entry.DeviceMajor = unix.Major(uint64(stat.Rdev))
+		entry.DeviceMinor = unix.Minor(uint64(stat.Rdev))
+	}
+	entry.OriginalSize = 0
+	return nil
+}
+
+// recreateSpecial makes a new special file at dst from the recorded entry
+// without ever opening or following anything
+func recreateSpecial(dst string, entry RecycleBinEntry) error {
+	if entry.FileType == fileTypeSymlink {
+		return os.Symlink(entry.LinkTarget, dst)
+	}
+
+	perm := uint32(0644)
+	if entry.Attrs != nil {
+		perm = uint32(entry.Attrs.Mode.Perm())
+	}
+
+	var mode uint32
+	var dev uint64
+	switch entry.FileType {
+	case fileTypeFIFO:
+		mode = unix.S_IFIFO
+	case fileTypeSocket:
+		mode = unix.S_IFSOCK
+	case fileTypeCharDevice:
+		mode = unix.S_IFCHR
+		dev = unix.Mkdev(entry.DeviceMajor, entry.DeviceMinor)
+	case fileTypeBlockDevice:
+		mode = unix.S_IFBLK
+		dev = unix.Mkdev(entry.DeviceMajor, entry.DeviceMinor)
+	default:
+		return fmt.Errorf("'%s' is not a special file", entry.OriginalPath)
+	}
+
+	return unix.Mknod(dst, mode|perm, int(dev))
+}
+
+// copySpecial duplicates the special file src at dst, used when a tree has to
+// be copied across devices
+func copySpecial(src, dst string, info os.FileInfo) error {
+	entry := RecycleBinEntry{OriginalPath: src, FileType: fileTypeName(info.Mode())}
+	if err := describeSpecial(src, info, &entry); err != nil {
+		return err
+	}
+	entry.Attrs = captureAttrs(src, info)
+
+	if err := recreateSpecial(dst, entry); err != nil {
+		return err
+	}
+	return applyAttrs(dst, entry.Attrs)
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/sys/unix"
+)
+
+// Store is a storage backend for the recycle bin. Entries are addressed by
+// their short ID; everything outside this file and the backends goes through it.
+type Store interface {
+	// Put moves the file or directory at path into the store. The caller fills
+	// in the entry's original path, deletion time, size and type; the store
+	// assigns the ID and storage fields.
+	Put(path string, entry *RecycleBinEntry) error
+	// Get moves the payload of entry id back out to dst and forgets the entry
+	Get(id, dst string) error
+	// List returns every entry in the store, oldest first
+	List() ([]RecycleBinEntry, error)
+	// Delete permanently removes entry id and its payload
+	Delete(id string) error
+	// Stat returns entry id and the number of bytes its payload occupies
+	Stat(id string) (RecycleBinEntry, int64, error)
+}
+
+// openStore returns the storage backend selected in config
+func openStore(config *RecycleBinConfig) Store {
+	if usesFreeDesktopTrash(config) {
+		return &trashStore{}
+	}
+	return newMountStore(config.RecycleBinPath, config.Dedup)
+}
+
+// pathFinder is implemented by stores that index entries by original path
+type pathFinder interface {
+	FindPath(name string) ([]RecycleBinEntry, error)
+}
+
+// findEntries returns the entries whose original path or base name is name
+func findEntries(store Store, name string) ([]RecycleBinEntry, error) {
+	if finder, ok := store.(pathFinder); ok {
+		return finder.FindPath(name)
+	}
+
+	entries, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []RecycleBinEntry
+	for _, entry := range entries {
+		if entry.OriginalPath == name || filepath.Base(entry.OriginalPath) == name {
+			matches = append(matches, entry)
+		}
+	}
+	return matches, nil
+}
+
+// renameNoReplace renames like os.Rename, but fails with an error matching
+// fs.ErrExist rather than replace newpath, where the file system allows
+func renameNoReplace(oldpath, newpath string) error {
+	err := unix.Renameat2(unix.AT_FDCWD, oldpath, unix.AT_FDCWD, newpath, unix.RENAME_NOREPLACE)
+	if err == unix.EINVAL || err == unix.ENOSYS {
+		return os.Rename(oldpath, newpath)
+	}
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	return nil
+}
+
+// countTree returns how many files and directories there are at path
+func countTree(path string) int {
+	count := 0
+	filepath.Walk(path, func(string, os.FileInfo, error) error {
+		count++
+		return nil
+	})
+	return count
+}
+
+func sortEntriesByTime(entries []RecycleBinEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].DeletedAt.Before(entries[j].DeletedAt)
+	})
+}
+
+// entryID derives the short ID shown by --list-recycle-bin from the name an
+// entry is stored under
+func entryID(key string) string {
+	sum := md5.Sum([]byte(key))
+	return hex.EncodeToString(sum[:])[:8]
+}
+
+// dirStore is better-rm's own layout: payloads (compressed for most files)
+// in the bin directory and an append-only index log under .metadata
+type dirStore struct {
+	root  string
+	dedup bool      // share identical contents through blobs when compacting
+	index *binIndex // loaded lazily
+
+	// The bin lock held by this process, see Lock
+	lockFile      *os.File
+	lockDepth     int
+	lockExclusive bool
+}
+
+func (s *dirStore) metadataDir() string {
+	return filepath.Join(s.root, ".metadata")
+}
+
+func (s *dirStore) storedPath(entry RecycleBinEntry) string {
+	return filepath.Join(s.root, entry.StoredName)
+}
+
+// storedName picks the name entry is stored under: its deletion time, a hash
+// of its original path and its base name. Deleting the same path twice within
+// a second adds a counter to the time, so names and IDs never collide.
+func (s *dirStore) storedName(entry RecycleBinEntry) string {
+	timestamp := entry.DeletedAt.Format("20060102_150405")
+	hasher := md5.New()
+	hasher.Write([]byte(entry.OriginalPath))
+	hash := hex.EncodeToString(hasher.Sum(nil))[:8]
+
+	baseName := filepath.Base(entry.OriginalPath)
+
+	name := fmt.Sprintf("%s_%s_%s", timestamp, hash, baseName)
+	for n := 2; s.nameTaken(name); n++ {
+		name = fmt.Sprintf("%s-%d_%s_%s", timestamp, n, hash, baseName)
+	}
+	return name
+}
+
+// nameTaken reports whether an entry already uses name, or its ID, or a
+// stored file exists under name in any compressed form
+func (s *dirStore) nameTaken(name string) bool {
+	if _, ok := s.index.get(entryID(name)); ok {
+		return true
+	}
+	for _, c := range codecs {
+		for _, stored := range []string{name + c.ext, name + archiveExt + c.ext} {
+			if _, err := os.Lstat(filepath.Join(s.root, stored)); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *dirStore) Put(originalPath string, entry *RecycleBinEntry) error {
+	unlock, err := s.Lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	// Settle a move a crashed rm left behind before starting another
+	if _, err := s.recoverJournal(); err != nil {
+		return err
+	}
+
+	// Generate unique filename for storage using timestamp and hash
+	storedName := s.storedName(*entry)
+
+	if isSpecialEntry(*entry) {
+		return s.putSpecial(originalPath, entry, storedName)
+	}
+
+	// Files are stored as they are and compressed later by a compaction
+	// pass, so deleting stays a rename
+	entry.StoredName = storedName
+	entry.ID = entryID(storedName)
+	entry.IsCompressed = false
+	entry.PendingCompression = entryCodec(*entry).name != codecNone
+
+	destPath := s.storedPath(*entry)
+
+	// Every step is journaled before it is taken, so a crash at any point
+	// leaves enough behind for recoverJournal to finish or undo the move
+	if err := s.journal(journalMove, originalPath, *entry); err != nil {
+		return err
+	}
+
+	var removeErr error
+	copied := false
+	if err := renameNoReplace(originalPath, destPath); err != nil && !errors.Is(err, unix.EXDEV) {
+		// Only another file system calls for a copy; anything else, such as
+		// a read-only parent, would stop removing the original as well
+		s.clearJournal()
+		return err
+	} else if err != nil {
+		if err := s.copyIn(originalPath, entry); err != nil {
+			return err
+		}
+		destPath = s.storedPath(*entry)
+		copied = true
+
+		// Once part of a directory is gone the copy is all that holds it, so
+		// the entry is kept; otherwise the original is still whole
+		before := countTree(originalPath)
+		if removeErr = os.RemoveAll(originalPath); removeErr != nil &&
+			!(entry.IsDirectory && countTree(originalPath) < before) {
+			os.RemoveAll(destPath)
+			s.clearJournal()
+			return removeErr
+		}
+	}
+
+	// Summing the stored copy rather than the original keeps a file that is
+	// replaced while being deleted from getting the wrong checksum. A copy
+	// has just been read in full anyway; a renamed file is summed by the
+	// compaction pass, so deleting stays a rename. One we can't read still
+	// goes in the bin, just without a checksum.
+	if entry.FileType == fileTypeRegular {
+		if copied {
+			entry.SHA256, _ = payloadSum(destPath, *entry)
+		} else {
+			entry.PendingChecksum = true
+		}
+	}
+
+	if err := s.index.put(*entry); err != nil {
+		// The journal still holds the move, so the next run records it
+		return err
+	}
+
+	// Once the entry is recorded a stale journal is harmless, see recoverJournal
+	s.clearJournal()
+
+	if removeErr != nil {
+		return fmt.Errorf("'%s' is in the recycle bin, but could not be removed completely: %v", originalPath, removeErr)
+	}
+	return nil
+}
+
+// copyIn copies the original into the bin when it can't be renamed there,
+// compressing or archiving it on the way if its codec asks for that. The
+// original is left for the caller to remove.
+func (s *dirStore) copyIn(originalPath string, entry *RecycleBinEntry) error {
+	c := entryCodec(*entry)
+	level := entryCodecLevel(*entry)
+	storedName := entry.StoredName
+
+	entry.PendingCompression = false
+	if c.name != codecNone {
+		entry.IsCompressed = true
+		if entry.IsDirectory {
+			// Archive straight from the original instead of copying it first
+			entry.IsArchive = true
+			entry.StoredName = storedName + archiveExt + c.ext
+		} else {
+			entry.StoredName = storedName + c.ext
+		}
+	}
+	entry.ID = entryID(entry.StoredName)
+	destPath := s.storedPath(*entry)
+
+	if err := s.journal(journalCopy, originalPath, *entry); err != nil {
+		return err
+	}
+
+	var err error
+	switch {
+	case entry.IsArchive:
+		err = archiveDir(originalPath, destPath, c, level)
+	case entry.IsDirectory:
+		err = copyDir(originalPath, destPath)
+	case entry.IsCompressed:
+		err = copyAndCompressFile(originalPath, destPath, c, level)
+	default:
+		err = copyFile(originalPath, destPath)
+	}
+	if err == nil {
+		err = syncFile(destPath)
+	}
+	if err == nil {
+		err = s.journal(journalCopied, originalPath, *entry)
+	}
+	if err != nil {
+		os.RemoveAll(destPath)
+		s.clearJournal()
+		return err
+	}
+
+	if entry.IsCompressed {
+		if stat, err := os.Stat(destPath); err == nil {
+			entry.CompressedSize = stat.Size()
+		}
+	}
+	return nil
+}
+
+// putSpecial records a symlink, FIFO, socket or device node. Nothing is
+// stored in the bin; the original goes away only once its entry is written.
+func (s *dirStore) putSpecial(originalPath string, entry *RecycleBinEntry, storedName string) error {
+	entry.StoredName = storedName
+	entry.ID = entryID(storedName)
+	entry.IsCompressed = false
+
+	if err := s.index.put(*entry); err != nil {
+		return err
+	}
+
+	if err := os.Remove(originalPath); err != nil {
+		s.index.remove(entry.ID)
+		return err
+	}
+	return nil
+}
+
+func (s *dirStore) Get(id, dst string) error {
+	unlock, err := s.Lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	entry, err := s.find(id)
+	if err != nil {
+		return err
+	}
+
+	if isSpecialEntry(entry) {
+		if err := recreateSpecial(dst, entry); err != nil {
+			return err
+		}
+		if err := applyAttrs(dst, entry.Attrs); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not restore attributes of '%s': %v\n", dst, err)
+		}
+		return s.index.remove(id)
+	}
+
+	storedPath := s.storedPath(entry)
+
+	if entry.IsArchive {
+		if err := extractArchive(storedPath, dst, entryCodec(entry)); err != nil {
+			return fmt.Errorf("failed to extract: %w", err)
+		}
+		os.Remove(storedPath)
+	} else if entry.IsCompressed && !entry.IsDirectory {
+		if err := decompressFile(storedPath, dst, entryCodec(entry)); err != nil {
+			return fmt.Errorf("failed to decompress: %w", err)
+		}
+		os.Remove(storedPath)
+	} else if entry.Blob != "" {
+		// A shared blob must stay intact, so the restored file gets its own copy
+		if err := copyFile(storedPath, dst); err != nil {
+			return err
+		}
+		os.Remove(storedPath)
+	} else {
+		// Something may have appeared at dst since the caller looked, and
+		// it is never replaced
+		if err := renameNoReplace(storedPath, dst); errors.Is(err, unix.EXDEV) {
+			if err := copyFile(storedPath, dst); err != nil {
+				return err
+			}
+			os.RemoveAll(storedPath)
+		} else if err != nil {
+			return err
+		}
+	}
+	s.releaseBlob(entry)
+
+	// Entries from before attributes were recorded only know the contents
+	if entry.Attrs == nil {
+		if entry.IsCompressed && !entry.IsDirectory {
+			os.Chmod(dst, 0644)
+		}
+	} else if err := applyAttrs(dst, entry.Attrs); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not restore attributes of '%s': %v\n", dst, err)
+	}
+
+	return s.index.remove(id)
+}
+
+func (s *dirStore) List() ([]RecycleBinEntry, error) {
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s.index.entries(), nil
+}
+
+func (s *dirStore) FindPath(name string) ([]RecycleBinEntry, error) {
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s.index.lookup(name), nil
+}
+
+// load opens the index once per process, and again whenever taking the lock
+// finds another process changed it
+func (s *dirStore) load() error {
+	if s.index != nil {
+		return nil
+	}
+
+	// Never read the log while another process is halfway through appending
+	unlock, err := s.Lock(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	index, err := openBinIndex(s.metadataDir())
+	if err != nil {
+		return err
+	}
+	s.index = index
+	return nil
+}
+
+func (s *dirStore) find(id string) (RecycleBinEntry, error) {
+	if err := s.load(); err != nil {
+		return RecycleBinEntry{}, err
+	}
+
+	entry, ok := s.index.get(id)
+	if !ok {
+		return RecycleBinEntry{}, fmt.Errorf("no entry with ID '%s' in recycle bin", id)
+	}
+	return entry, nil
+}
+
+func (s *dirStore) Delete(id string) error {
+	unlock, err := s.Lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	entry, err := s.find(id)
+	if err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(s.storedPath(entry)); err != nil {
+		return err
+	}
+	s.releaseBlob(entry)
+	return s.index.remove(id)
+}
+
+func (s *dirStore) Stat(id string) (RecycleBinEntry, int64, error) {
+	entry, err := s.find(id)
+	if err != nil {
+		return RecycleBinEntry{}, 0, err
+	}
+
+	if isSpecialEntry(entry) {
+		return entry, 0, nil
+	}
+
+	info, err := os.Lstat(s.storedPath(entry))
+	if err != nil {
+		return entry, 0, err
+	}
+	if info.IsDir() {
+		return entry, getDirSize(s.storedPath(entry)), nil
+	}
+	return entry, info.Size(), nil
+}
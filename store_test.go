@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestStore returns an empty bin in a temporary directory, and that
+// directory for the files to delete into it
+func newTestStore(t *testing.T) (*dirStore, string) {
+	t.Helper()
+	base := t.TempDir()
+	s := &dirStore{root: filepath.Join(base, "bin")}
+	if err := os.MkdirAll(s.metadataDir(), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return s, base
+}
+
+// putForTest moves path into the bin at root with codec, compacting it so
+// it ends up compressed or archived unless codec is none
+func putForTest(t *testing.T, s *dirStore, path, codec string) RecycleBinEntry {
+	t.Helper()
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry := RecycleBinEntry{
+		OriginalPath: path,
+		DeletedAt:    time.Now(),
+		OriginalSize: info.Size(),
+		IsDirectory:  info.IsDir(),
+		FileType:     fileTypeName(info.Mode()),
+		Codec:        codec,
+	}
+	if err := s.Put(path, &entry); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err = s.find(entry.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entry
+}
+
+// TestGetKeepsExistingDestination restores each kind of stored entry onto a
+// path something appeared at since the caller checked, which must fail and
+// leave what is there alone
+func TestGetKeepsExistingDestination(t *testing.T) {
+	tests := []struct {
+		name  string
+		dir   bool
+		codec string
+	}{
+		{"renamed file", false, codecNone},
+		{"compressed file", false, codecGzip},
+		{"renamed directory", true, codecNone},
+		{"archived directory", true, codecGzip},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, base := newTestStore(t)
+
+			original := filepath.Join(base, "item")
+			if tt.dir {
+				if err := os.MkdirAll(filepath.Join(original, "sub"), 0755); err != nil {
+					t.Fatal(err)
+				}
+				os.WriteFile(filepath.Join(original, "sub", "f"), []byte("deleted"), 0644)
+			} else {
+				os.WriteFile(original, []byte("deleted"), 0644)
+			}
+			entry := putForTest(t, s, original, tt.codec)
+
+			// What appeared at the destination in the meantime
+			marker := filepath.Join(original, "mine")
+			if tt.dir {
+				os.Mkdir(original, 0755)
+				os.WriteFile(marker, []byte("keep"), 0644)
+			} else {
+				marker = original
+				os.WriteFile(marker, []byte("keep"), 0644)
+			}
+
+			if err := s.Get(entry.ID, original); err == nil {
+				t.Fatal("Get succeeded over an existing destination")
+			}
+			if data, err := os.ReadFile(marker); err != nil || string(data) != "keep" {
+				t.Fatalf("existing destination was changed: %q, %v", data, err)
+			}
+			if _, err := s.find(entry.ID); err != nil {
+				t.Fatalf("entry left the bin: %v", err)
+			}
+		})
+	}
+}
+
+// TestCompactRecordsChecksum checks that a file renamed into the bin is left
+// without a checksum by the delete and gets one from the compaction pass,
+// whether or not it is compressed there
+func TestCompactRecordsChecksum(t *testing.T) {
+	sum := sha256.Sum256([]byte("deleted"))
+	want := hex.EncodeToString(sum[:])
+
+	for _, codec := range []string{codecNone, codecGzip} {
+		t.Run(codec, func(t *testing.T) {
+			s, base := newTestStore(t)
+
+			original := filepath.Join(base, "item")
+			os.WriteFile(original, []byte("deleted"), 0644)
+			entry := RecycleBinEntry{
+				OriginalPath: original,
+				DeletedAt:    time.Now(),
+				OriginalSize: 7,
+				FileType:     fileTypeRegular,
+				Codec:        codec,
+			}
+			if err := s.Put(original, &entry); err != nil {
+				t.Fatal(err)
+			}
+			if !entry.PendingChecksum || entry.SHA256 != "" {
+				t.Fatalf("Put recorded checksum %q, pending %v; want it left to compaction", entry.SHA256, entry.PendingChecksum)
+			}
+
+			if _, err := s.Compact(); err != nil {
+				t.Fatal(err)
+			}
+			entry, err := s.find(entry.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry.PendingChecksum || entry.SHA256 != want {
+				t.Fatalf("after compaction checksum is %q, pending %v; want %s", entry.SHA256, entry.PendingChecksum, want)
+			}
+			if err := s.Verify(entry.ID); err != nil {
+				t.Fatalf("verify: %v", err)
+			}
+		})
+	}
+}
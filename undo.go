@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// newTransactionID returns the ID shared by every entry one invocation creates
+func newTransactionID() string {
+	buf := make([]byte, 4)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%08x", uint32(time.Now().UnixNano()))
+	}
+	return hex.EncodeToString(buf)
+}
+
+// transactionEntries returns the entries of transaction txID, or of the most
+// recent transaction when txID is empty
+func transactionEntries(store Store, txID string) ([]RecycleBinEntry, string, error) {
+	entries, err := store.List()
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Entries come back oldest first, so the last one tagged is the latest
+	if txID == "" {
+		for i := len(entries) - 1; i >= 0; i-- {
+			if entries[i].TransactionID != "" {
+				txID = entries[i].TransactionID
+				break
+			}
+		}
+		if txID == "" {
+			return nil, "", nil
+		}
+	}
+
+	var matches []RecycleBinEntry
+	for _, entry := range entries {
+		if entry.TransactionID == txID {
+			matches = append(matches, entry)
+		}
+	}
+	return matches, txID, nil
+}
+
+func undoTransaction(txID string, opts restoreOptions) {
+	config, err := loadRecycleBinConfig()
+	if err != nil {
+		failf(codeConfig, "Failed to load config: %v", err)
+		return
+	}
+
+	store := openStore(config)
+	entries, txID, err := transactionEntries(store, txID)
+	if err != nil {
+		failf(errorCode(err), "Failed to read recycle bin: %v", err)
+		return
+	}
+
+	if len(entries) == 0 {
+		if txID == "" {
+			failf(codeNotFound, "Nothing to undo")
+		} else {
+			failf(codeNotFound, "No entries from transaction '%s' in recycle bin", txID)
+		}
+		return
+	}
+
+	// Check every destination before touching anything, so an undo either
+	// restores the whole transaction or nothing at all, unless --on-conflict
+	// says how to handle them one by one
+	conflicts, err := destinationConflicts(entries, opts)
+	if err != nil {
+		failf(errorCode(err), "Invalid restore destination: %v", err)
+		return
+	}
+	if len(conflicts) > 0 {
+		out.hint("Error: Cannot undo transaction '%s', these paths are in the way:\n", txID)
+		for _, conflict := range conflicts {
+			out.fail(conflict, "  %s (%s)\n", conflict.Path, conflict.Message)
+		}
+		out.hint("Move them out of the way, pick --on-conflict or restore entries individually with --restore-id\n")
+		return
+	}
+
+	restored := restoreEntries(store, entries, opts)
+	out.summarize(map[string]int{"restored": restored, "matched": len(entries)},
+		"Undid transaction '%s': restored %d of %d items\n", txID, restored, len(entries))
+}
+
+// destinationConflicts returns what stands in the way of restoring all of
+// entries at once: a path that already exists, or one that several entries
+// would be restored to. With an --on-conflict policy there are none.
+func destinationConflicts(entries []RecycleBinEntry, opts restoreOptions) ([]outputError, error) {
+	var conflicts []outputError
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		dst, err := opts.destination(entry, true)
+		if err != nil {
+			return nil, err
+		}
+		if opts.onConflict != "" {
+			continue
+		}
+		if _, err := os.Lstat(dst); err == nil {
+			conflicts = append(conflicts, outputError{Code: codeConflict, Message: "already exists", Path: dst})
+		} else if seen[dst] {
+			conflicts = append(conflicts, outputError{Code: codeAmbiguous, Message: "destination of several entries", Path: dst})
+		}
+		seen[dst] = true
+	}
+	return conflicts, nil
+}
+
+// restoreEntries restores entries into place, or into the directory opts
+// names, reporting each one, and returns how many made it back. Without an
+// --on-conflict policy the destinations must have been checked already.
+func restoreEntries(store Store, entries []RecycleBinEntry, opts restoreOptions) int {
+	// Parents before children, in case pieces of one tree were binned separately
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].OriginalPath < entries[j].OriginalPath
+	})
+
+	if opts.onConflict == "" {
+		// Only something created since the check can be in the way
+		opts.onConflict = conflictAsk
+	}
+
+	// A file overwritten by one restore goes to the bin, and making room
+	// for it must not evict an entry still waiting its turn. They all leave
+	// the bin shortly, so it ends up under its limit again.
+	opts.batch = make(map[string]bool)
+	for _, entry := range entries {
+		opts.batch[entry.ID] = true
+	}
+
+	restored := 0
+	for _, entry := range entries {
+		dst, err := opts.destination(entry, true)
+		if err != nil {
+			reportRestoreError(entry, err)
+			continue
+		}
+		if restoreWithPolicy(store, entry, dst, opts) {
+			restored++
+		}
+	}
+	return restored
+}
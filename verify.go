@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// verifier is implemented by stores that can check their payloads for damage
+type verifier interface {
+	// Verify checks that the payload of entry id is present and reads back
+	// intact, matching its recorded checksum if it has one
+	Verify(id string) error
+	// Orphans returns the stored files no entry refers to
+	Orphans() ([]string, error)
+}
+
+// verifyPayload reads the payload of entry stored at path in full. Files are
+// decompressed and compared with entry.SHA256; archives are read through,
+// which checks the codec's own checksums.
+func verifyPayload(path string, entry RecycleBinEntry) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case entry.IsArchive:
+		return checkArchive(path, entryCodec(entry))
+	case entry.IsDirectory:
+		if !info.IsDir() {
+			return fmt.Errorf("stored directory '%s' is not a directory", path)
+		}
+		return nil
+	case !info.Mode().IsRegular():
+		// Symlinks and the like in the desktop Trash have no contents to check
+		return nil
+	}
+
+	sum, err := payloadSum(path, entry)
+	if err != nil {
+		return err
+	}
+	if entry.SHA256 != "" && sum != entry.SHA256 {
+		return fmt.Errorf("checksum mismatch: recorded %s, stored content is %s", entry.SHA256[:12], sum[:12])
+	}
+	return nil
+}
+
+// payloadSum returns the SHA-256 of the contents of the file entry stores at
+// path, decompressing it if needed
+func payloadSum(path string, entry RecycleBinEntry) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if entry.IsCompressed {
+		reader, err := entryCodec(entry).newReader(f)
+		if err != nil {
+			return "", err
+		}
+		defer reader.Close()
+		r = reader
+	}
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, r); err != nil {
+		return "", fmt.Errorf("unreadable payload: %w", err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func (s *dirStore) Verify(id string) error {
+	unlock, err := s.Lock(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	entry, err := s.find(id)
+	if err != nil {
+		return err
+	}
+	if isSpecialEntry(entry) {
+		return nil
+	}
+	return verifyPayload(s.storedPath(entry), entry)
+}
+
+// Orphans lists names in the bin directory that no entry is stored under,
+// and blobs that no entry links to. In-flight compaction copies are skipped.
+func (s *dirStore) Orphans() ([]string, error) {
+	unlock, err := s.Lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	live := make(map[string]bool)
+	for _, entry := range s.index.entries() {
+		live[entry.StoredName] = true
+	}
+
+	names, err := os.ReadDir(s.root)
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []string
+	for _, name := range names {
+		switch {
+		case name.Name() == ".metadata", name.Name() == blobDirName:
+		case isCompactionTemp(name.Name(), live):
+		case !live[name.Name()]:
+			orphans = append(orphans, filepath.Join(s.root, name.Name()))
+		}
+	}
+
+	filepath.Walk(filepath.Join(s.root, blobDirName), func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() && linkCount(path) == 1 {
+			orphans = append(orphans, path)
+		}
+		return nil
+	})
+
+	return orphans, nil
+}
+
+func (s *mountStore) Verify(id string) error {
+	bin, err := s.find(id)
+	if err != nil {
+		return err
+	}
+	return bin.Verify(id)
+}
+
+func (s *mountStore) Orphans() ([]string, error) {
+	var orphans []string
+	for _, bin := range s.discover() {
+		binOrphans, err := bin.Orphans()
+		if err != nil {
+			if bin == s.home {
+				return nil, err
+			}
+			continue
+		}
+		orphans = append(orphans, binOrphans...)
+	}
+	return orphans, nil
+}
+
+func (s *trashStore) Verify(id string) error {
+	item, err := s.find(id)
+	if err != nil {
+		return err
+	}
+	return verifyPayload(item.storedPath, item.entry)
+}
+
+// Orphans lists files in the trashes that have no .trashinfo
+func (s *trashStore) Orphans() ([]string, error) {
+	var orphans []string
+	for _, dir := range knownTrashDirs() {
+		names, err := os.ReadDir(filepath.Join(dir.path, "files"))
+		if err != nil {
+			continue
+		}
+		for _, name := range names {
+			infoPath := filepath.Join(dir.path, "info", name.Name()+".trashinfo")
+			if _, err := os.Lstat(infoPath); os.IsNotExist(err) {
+				orphans = append(orphans, filepath.Join(dir.path, "files", name.Name()))
+			}
+		}
+	}
+	return orphans, nil
+}
+
+func verifyRecycleBin() {
+	config, err := loadRecycleBinConfig()
+	if err != nil {
+		failf(codeConfig, "Failed to load config: %v", err)
+		return
+	}
+
+	store := openStore(config)
+	v, ok := store.(verifier)
+	if !ok {
+		failf(codeUnsupported, "This recycle bin backend cannot be verified")
+		return
+	}
+
+	entries, err := store.List()
+	if err != nil {
+		failf(errorCode(err), "Failed to read recycle bin: %v", err)
+		return
+	}
+
+	var corrupt, missing, unverified int
+	for _, entry := range entries {
+		rec := outputRecord{Type: "checked", Status: "ok", ID: entry.ID, Path: entry.OriginalPath}
+		err := v.Verify(entry.ID)
+		switch {
+		case err == nil && entry.FileType == fileTypeRegular && entry.SHA256 == "":
+			// It reads back, but with nothing to compare it against
+			rec.Status, rec.Message = "unverified", "no checksum recorded yet"
+			out.emit(rec, "Unverified %-8s %s: no checksum recorded yet\n", entry.ID, entry.OriginalPath)
+			unverified++
+		case err == nil:
+			out.record(rec)
+		case errors.Is(err, fs.ErrNotExist):
+			rec.Status = "missing"
+			out.emit(rec, "Missing   %-8s %s\n", entry.ID, entry.OriginalPath)
+			missing++
+		default:
+			rec.Status, rec.Message = "corrupt", err.Error()
+			out.emit(rec, "Corrupt   %-8s %s: %v\n", entry.ID, entry.OriginalPath, err)
+			corrupt++
+		}
+	}
+
+	orphans, err := v.Orphans()
+	if err != nil {
+		failf(errorCode(err), "Failed to scan recycle bin: %v", err)
+		return
+	}
+	for _, path := range orphans {
+		out.emit(outputRecord{Type: "orphan", Path: path}, "Orphaned  %s\n", path)
+	}
+
+	out.summarize(map[string]int{"entries": len(entries), "corrupt": corrupt, "missing": missing, "unverified": unverified, "orphaned": len(orphans)},
+		"Verified %d entries: %d corrupt, %d missing, %d unverified, %d orphaned files\n",
+		len(entries), corrupt, missing, unverified, len(orphans))
+	if unverified > 0 {
+		out.hint("Unverified files get their checksum from --compact-recycle-bin\n")
+	}
+	if corrupt+missing+len(orphans) > 0 {
+		out.exit(1)
+	}
+}